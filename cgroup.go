@@ -0,0 +1,9 @@
+package sh
+
+import "time"
+
+// cgroupLimits are the resource limits set using WithCgroupLimits.
+type cgroupLimits struct {
+	cpuQuota time.Duration
+	memBytes int64
+}
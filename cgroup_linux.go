@@ -0,0 +1,246 @@
+package sh
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	cgroupRoot      = "/sys/fs/cgroup"
+	cgroupCPUPeriod = 100 * time.Millisecond
+
+	// cgroupLeaf is the group MoveToCgroupLeaf moves the current process
+	// to, so controllers can be enabled in the group it was in.
+	cgroupLeaf = "sh-leaf"
+)
+
+var (
+	cgroupCount atomic.Uint64
+
+	// cgroupMu serializes enabling controllers
+	// and moving the current process.
+	cgroupMu sync.Mutex
+)
+
+// cgroup is a cgroup v2 group created for a single run of a script.
+type cgroup struct {
+	dir  *os.File
+	path string
+}
+
+// attachCgroup creates a new group with the limits applied
+// and configures cmd to start the script in it.
+func attachCgroup(cmd *exec.Cmd, limits *cgroupLimits) (*cgroup, error) {
+	parent, err := currentCgroup()
+	if err != nil {
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+	// The current process was moved to the leaf by an earlier run.
+	if filepath.Base(parent) == cgroupLeaf {
+		parent = filepath.Dir(parent)
+	}
+
+	var controllers []string
+	if limits.cpuQuota > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if limits.memBytes > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if err := enableControllers(parent, controllers); err != nil {
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+
+	path := filepath.Join(parent, fmt.Sprintf("sh-%d-%d", os.Getpid(), cgroupCount.Add(1)))
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+
+	cg := &cgroup{path: path}
+	if err := cg.setLimits(limits); err != nil {
+		cg.remove()
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+
+	cg.dir, err = os.Open(path)
+	if err != nil {
+		cg.remove()
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.dir.Fd())
+
+	return cg, nil
+}
+
+func (cg *cgroup) setLimits(limits *cgroupLimits) error {
+	if limits.cpuQuota > 0 {
+		quota := fmt.Sprintf("%d %d", limits.cpuQuota.Microseconds(), cgroupCPUPeriod.Microseconds())
+		if err := cg.write("cpu.max", quota); err != nil {
+			return err
+		}
+	}
+
+	if limits.memBytes > 0 {
+		if err := cg.write("memory.max", fmt.Sprint(limits.memBytes)); err != nil {
+			return err
+		}
+		// Without swap the limit is enforced by killing the script
+		// instead of slowing it down. Swap accounting may be disabled.
+		if err := cg.write("memory.swap.max", "0"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cg *cgroup) write(name, value string) error {
+	return os.WriteFile(filepath.Join(cg.path, name), []byte(value), 0)
+}
+
+// remove kills the processes left in the group and removes it.
+func (cg *cgroup) remove() {
+	if cg.dir != nil {
+		cg.dir.Close()
+		cg.dir = nil
+	}
+
+	// cgroup.kill is available since Linux 5.14.
+	cg.write("cgroup.kill", "1")
+
+	// The group can only be removed once the killed processes exit.
+	for i := 0; i < 100; i++ {
+		err := os.Remove(cg.path)
+		if err == nil || !errors.Is(err, syscall.EBUSY) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// currentCgroup returns the path of the cgroup v2 group
+// the current process belongs to.
+func currentCgroup() (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("cgroup v2 is not mounted at %s: %w", cgroupRoot, errors.ErrUnsupported)
+	}
+
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return filepath.Join(cgroupRoot, path), nil
+		}
+	}
+
+	return "", errors.New("current cgroup v2 group not found")
+}
+
+// MoveToCgroupLeaf moves the current process from its cgroup v2 group
+// to a new child group named "sh-leaf".
+//
+// A group with processes cannot enable controllers for its children,
+// unless it is the root group, so WithCgroupLimits fails in the group
+// the current process belongs to. Call MoveToCgroupLeaf once, before
+// running scripts, to allow it. Other processes in the group still make
+// WithCgroupLimits fail. Calling it again does nothing.
+func MoveToCgroupLeaf() error {
+	cgroupMu.Lock()
+	defer cgroupMu.Unlock()
+
+	current, err := currentCgroup()
+	if err != nil {
+		return fmt.Errorf("cgroup: %w", err)
+	}
+	if filepath.Base(current) == cgroupLeaf {
+		return nil
+	}
+
+	if err := moveToLeaf(current); err != nil {
+		return fmt.Errorf("cgroup: %w", err)
+	}
+	return nil
+}
+
+// enableControllers enables controllers for the children of the group at path.
+func enableControllers(path string, controllers []string) error {
+	cgroupMu.Lock()
+	defer cgroupMu.Unlock()
+
+	available, err := readFields(filepath.Join(path, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	enabled, err := readFields(filepath.Join(path, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, c := range controllers {
+		if !slices.Contains(available, c) {
+			return fmt.Errorf("%s controller is not available in %s: %w", c, path, errors.ErrUnsupported)
+		}
+		if !slices.Contains(enabled, c) {
+			missing = append(missing, "+"+c)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	err = os.WriteFile(filepath.Join(path, "cgroup.subtree_control"), []byte(strings.Join(missing, " ")), 0)
+	if errors.Is(err, syscall.EBUSY) {
+		return fmt.Errorf("enabling controllers %v: %s has processes, see MoveToCgroupLeaf: %w", controllers, path, err)
+	}
+	if err != nil {
+		return fmt.Errorf("enabling controllers %v: %w", controllers, err)
+	}
+
+	return nil
+}
+
+// moveToLeaf moves the current process from the group at path
+// to its leaf child group.
+func moveToLeaf(path string) error {
+	leaf := filepath.Join(path, cgroupLeaf)
+	if err := os.Mkdir(leaf, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("creating leaf group: %w", err)
+	}
+
+	err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0)
+	if err != nil {
+		return fmt.Errorf("moving the current process to %s: %w", leaf, err)
+	}
+
+	return nil
+}
+
+func readFields(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
@@ -0,0 +1,52 @@
+package sh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCgroupLimits(t *testing.T) {
+	cg, err := attachCgroup(exec.Command("true"), &cgroupLimits{memBytes: 32 << 20})
+	// The test does not move the test binary using MoveToCgroupLeaf,
+	// so it only runs where controllers can be enabled as is.
+	if errors.Is(err, errors.ErrUnsupported) || errors.Is(err, os.ErrPermission) ||
+		errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.EBUSY) {
+		t.Skipf("cgroups are not available: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("attachCgroup() error = %v", err)
+	}
+	cg.remove()
+
+	env := NewEnvironment(Bash(), WithCgroupLimits(0, 32<<20))
+
+	out, err := env.Output(context.Background(), "cat /proc/self/cgroup")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if !strings.Contains(string(out), "/sh-") {
+		t.Errorf("Output() = %q, want the script in a new group", out)
+	}
+
+	// The script keeps 256MiB in a variable, well above the limit.
+	err = env.Run(context.Background(), `x=$(head -c 268435456 /dev/zero | tr '\0' a); echo ${#x}`)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Run() error = %v, want an exit error", err)
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); !ok || ws.Signal() != syscall.SIGKILL {
+		t.Errorf("Run() error = %v, want the script killed", err)
+	}
+
+	left, _ := filepath.Glob(filepath.Join(filepath.Dir(cg.path), fmt.Sprintf("sh-%d-*", os.Getpid())))
+	if len(left) > 0 {
+		t.Errorf("cgroups %v were not removed", left)
+	}
+}
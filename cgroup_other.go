@@ -0,0 +1,22 @@
+//go:build !linux
+
+package sh
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// MoveToCgroupLeaf is only supported on Linux.
+func MoveToCgroupLeaf() error {
+	return fmt.Errorf("cgroup: %w", errors.ErrUnsupported)
+}
+
+type cgroup struct{}
+
+func attachCgroup(cmd *exec.Cmd, limits *cgroupLimits) (*cgroup, error) {
+	return nil, fmt.Errorf("cgroup: %w", errors.ErrUnsupported)
+}
+
+func (cg *cgroup) remove() {}
@@ -0,0 +1,50 @@
+package sh
+
+// DockerExec returns a Shell that runs scripts inside a running
+// container using "docker exec", with shell as the shell inside the container.
+//
+// The variables set using WithEnv and extra args are passed
+// to the container using -e KEY=VALUE flags.
+func DockerExec(container string, shell Shell) Shell {
+	return &dockerExec{
+		container: container,
+		shell:     shell,
+	}
+}
+
+type dockerExec struct {
+	container string
+	shell     Shell
+}
+
+func (d *dockerExec) Name() string {
+	return "docker"
+}
+
+func (d *dockerExec) Prefix() []string {
+	args := []string{"exec", "-i", d.container, d.shell.Name()}
+	return append(args, d.shell.Prefix()...)
+}
+
+func (d *dockerExec) Suffix() []string {
+	return d.shell.Suffix()
+}
+
+func (d *dockerExec) FormatArgs(inv Invocation) []string {
+	args := []string{"exec", "-i"}
+	for _, arg := range inv.Env {
+		args = append(args, "-e", arg.String())
+	}
+	args = append(args, d.container)
+
+	return append(args, innerArgs(d.shell, inv)...)
+}
+
+func (d *dockerExec) wrapped() Shell {
+	return d.shell
+}
+
+func (d *dockerExec) Supports(feature string) bool {
+	fr, ok := d.shell.(FeatureReporter)
+	return ok && fr.Supports(feature)
+}
@@ -0,0 +1,53 @@
+package sh
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"slices"
+	"testing"
+)
+
+func TestDockerExecArgs(t *testing.T) {
+	shell := DockerExec("app", Sh())
+	if shell.Name() != "docker" {
+		t.Errorf("Name() = %v, want docker", shell.Name())
+	}
+
+	wantPrefix := []string{"exec", "-i", "app", "sh", "-c"}
+	if !slices.Equal(shell.Prefix(), wantPrefix) {
+		t.Errorf("Prefix() = %q, want %q", shell.Prefix(), wantPrefix)
+	}
+
+	env := NewEnvironment(shell)
+	defer env.cleanup()
+
+	cmd, err := env.command(context.Background(), source{script: "echo $FOO"}, "FOO", "bar baz")
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+
+	want := []string{"docker", "exec", "-i", "-e", "FOO=bar baz", "app", "sh", "-c", "echo $FOO"}
+	if !slices.Equal(cmd.Args, want) {
+		t.Errorf("command() args = %q, want %q", cmd.Args, want)
+	}
+}
+
+func TestDockerExec(t *testing.T) {
+	container := os.Getenv("SH_TEST_DOCKER_CONTAINER")
+	if container == "" {
+		t.Skip("SH_TEST_DOCKER_CONTAINER is not set")
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not installed")
+	}
+
+	out, err := NewEnvironment(DockerExec(container, Sh())).Output(context.Background(), "echo $FOO", "FOO", "bar")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if string(out) != "bar\n" {
+		t.Errorf("Output() = %q, want %q", out, "bar\n")
+	}
+}
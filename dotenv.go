@@ -0,0 +1,110 @@
+package sh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readEnvFile reads the variables defined in the dotenv file at path,
+// in the order they appear.
+func readEnvFile(path string) ([]Arg, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("env file: %w", err)
+	}
+	defer f.Close()
+
+	var vars []Arg
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		arg, err := parseEnvLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("env file %s:%d: %w", path, n, err)
+		}
+		vars = append(vars, arg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("env file: %w", err)
+	}
+
+	return vars, nil
+}
+
+// parseEnvLine parses a single KEY=VALUE line of a dotenv file.
+func parseEnvLine(line string) (Arg, error) {
+	line = strings.TrimPrefix(line, "export ")
+
+	// The line is not included in the errors, since it may hold a secret.
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return Arg{}, errors.New("missing '='")
+	}
+
+	key = strings.TrimSpace(key)
+	if !isValidName(key) {
+		return Arg{}, errors.New("invalid environment variable name")
+	}
+
+	value, err := parseEnvValue(strings.TrimSpace(value))
+	if err != nil {
+		return Arg{}, err
+	}
+
+	return Arg{Key: key, Value: value}, nil
+}
+
+// parseEnvValue unquotes value. Single-quoted values are taken literally,
+// double-quoted values support the \n, \t, \", \\ and \$ escapes, and unquoted
+// values end at a # preceded by a space.
+func parseEnvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch quote := value[0]; quote {
+	case '\'':
+		end := strings.IndexByte(value[1:], quote)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		return value[1 : end+1], nil
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(value); i++ {
+			c := value[i]
+			switch {
+			case c == '"':
+				return b.String(), nil
+			case c == '\\' && i+1 < len(value):
+				i++
+				switch value[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case '"', '\\', '$':
+					b.WriteByte(value[i])
+				default:
+					b.WriteByte('\\')
+					b.WriteByte(value[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated quoted value")
+	}
+
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value), nil
+}
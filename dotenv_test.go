@@ -0,0 +1,67 @@
+package sh
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	content := `# comment
+FOO="hello world" 
+export BAR='$NOT_EXPANDED # kept'
+BAZ=plain # trailing comment
+OVERRIDE=file
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	env := NewEnvironment(
+		Bash(),
+		WithEnvFile(path),
+		WithEnv(map[string]string{"OVERRIDE": "env"}),
+	)
+
+	out, err := env.Output(context.Background(), `echo "$FOO|$BAR|$BAZ|$OVERRIDE"`)
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	want := "hello world|$NOT_EXPANDED # kept|plain|env\n"
+	if string(out) != want {
+		t.Errorf("Output() = %q, want %q", out, want)
+	}
+}
+
+func TestParseEnvLine(t *testing.T) {
+	tt := []struct {
+		line    string
+		want    Arg
+		wantErr bool
+	}{
+		{line: "A=1", want: Arg{Key: "A", Value: "1"}},
+		{line: "A = 1", want: Arg{Key: "A", Value: "1"}},
+		{line: "A=", want: Arg{Key: "A", Value: ""}},
+		{line: `A="a\nb \"c\""`, want: Arg{Key: "A", Value: "a\nb \"c\""}},
+		{line: `A='a\nb # c'`, want: Arg{Key: "A", Value: `a\nb # c`}},
+		{line: "A=a#b", want: Arg{Key: "A", Value: "a#b"}},
+		{line: "A", wantErr: true},
+		{line: "1A=1", wantErr: true},
+		{line: `A="unterminated`, wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.line, func(t *testing.T) {
+			got, err := parseEnvLine(tc.line)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseEnvLine() error = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("parseEnvLine() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
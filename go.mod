@@ -1,3 +1,5 @@
 module github.com/nikola-jokic/sh
 
 go 1.21.1
+
+require golang.org/x/text v0.14.0
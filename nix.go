@@ -0,0 +1,47 @@
+package sh
+
+// NixShell returns a Shell that runs scripts using shell inside
+// a nix-shell environment providing the packages in expr,
+// as in "nix-shell -p expr --run command".
+//
+// The variables set using WithEnv and extra args are passed
+// through the environment of nix-shell, which keeps them
+// unless --pure is passed using WithShellArgs.
+func NixShell(expr string, shell Shell) Shell {
+	return &nixShell{
+		expr:  expr,
+		shell: shell,
+	}
+}
+
+type nixShell struct {
+	expr  string
+	shell Shell
+}
+
+func (n *nixShell) Name() string {
+	return "nix-shell"
+}
+
+func (n *nixShell) Prefix() []string {
+	return []string{"-p", n.expr, "--run"}
+}
+
+func (n *nixShell) Suffix() []string {
+	return nil
+}
+
+func (n *nixShell) FormatArgs(inv Invocation) []string {
+	// The variables are already set in the environment of nix-shell.
+	inv.Env = nil
+	return []string{"-p", n.expr, "--run", remoteCommand(n.shell, inv)}
+}
+
+func (n *nixShell) wrapped() Shell {
+	return n.shell
+}
+
+func (n *nixShell) Supports(feature string) bool {
+	fr, ok := n.shell.(FeatureReporter)
+	return ok && fr.Supports(feature)
+}
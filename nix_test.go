@@ -0,0 +1,46 @@
+package sh
+
+import (
+	"context"
+	"os/exec"
+	"slices"
+	"testing"
+)
+
+func TestNixShellArgs(t *testing.T) {
+	shell := NixShell("hello", Bash())
+	if shell.Name() != "nix-shell" {
+		t.Errorf("Name() = %v, want nix-shell", shell.Name())
+	}
+
+	env := NewEnvironment(shell)
+	defer env.cleanup()
+
+	cmd, err := env.command(context.Background(), source{script: "echo $FOO $1"}, "FOO", "bar", Positional("a b"))
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+
+	want := []string{"nix-shell", "-p", "hello", "--run", `bash -c 'echo $FOO $1' bash 'a b'`}
+	if !slices.Equal(cmd.Args, want) {
+		t.Errorf("command() args = %q, want %q", cmd.Args, want)
+	}
+	if !slices.Contains(cmd.Env, "FOO=bar") {
+		t.Errorf("command() env does not contain FOO=bar")
+	}
+}
+
+func TestNixShell(t *testing.T) {
+	if _, err := exec.LookPath("nix-shell"); err != nil {
+		t.Skip("nix-shell is not installed")
+	}
+
+	out, err := NewEnvironment(NixShell("hello", Bash())).Output(context.Background(), "hello >/dev/null && echo $FOO", "FOO", "bar")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if string(out) != "bar\n" {
+		t.Errorf("Output() = %q, want %q", out, "bar\n")
+	}
+}
@@ -0,0 +1,62 @@
+package sh
+
+import (
+	"io"
+	"os"
+)
+
+// terminal is a pseudo-terminal the script is attached to.
+//
+// The output written to the terminal is copied to out,
+// and in is copied to the terminal as the script's input.
+type terminal struct {
+	master *os.File
+	slave  *os.File
+	done   chan struct{}
+}
+
+func newTerminal(master, slave *os.File, in io.Reader, out io.Writer) *terminal {
+	t := &terminal{
+		master: master,
+		slave:  slave,
+		done:   make(chan struct{}),
+	}
+
+	if out == nil {
+		out = io.Discard
+	}
+	go func() {
+		defer close(t.done)
+		// Reading from the master fails with EIO once every
+		// process holding the terminal has closed it.
+		io.Copy(out, t.master)
+		// Keep reading if out fails, so the script
+		// does not block writing to the terminal.
+		io.Copy(io.Discard, t.master)
+	}()
+
+	if in != nil {
+		go io.Copy(t.master, in)
+	}
+
+	return t
+}
+
+// started closes the copy of the terminal held by the current process
+// after the script is started, so the output ends when the script exits.
+func (t *terminal) started() {
+	t.slave.Close()
+}
+
+// wait waits for the output of the script to be copied
+// and closes the terminal.
+func (t *terminal) wait() {
+	<-t.done
+	t.master.Close()
+}
+
+// close closes the terminal without waiting for the output.
+func (t *terminal) close() {
+	t.slave.Close()
+	t.master.Close()
+}
@@ -0,0 +1,81 @@
+package sh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// attachPTY connects the standard streams of cmd to a new pseudo-terminal,
+// making it the controlling terminal of the script.
+func attachPTY(cmd *exec.Cmd) (*terminal, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, fmt.Errorf("pty: %w", err)
+	}
+
+	t := newTerminal(master, slave, cmd.Stdin, cmd.Stdout)
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	// The new session is also a new process group,
+	// and Setpgid cannot be used by a session leader.
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+
+	return t, nil
+}
+
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var n uint32
+	err = ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	if err == nil {
+		var unlock int32
+		err = ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+	}
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	slave, err = os.OpenFile("/dev/pts/"+strconv.FormatUint(uint64(n), 10), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	return master, slave, nil
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package sh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPTY(t *testing.T) {
+	env := NewEnvironment(Bash(), WithPTY(), WithStdin(strings.NewReader("hello\n")))
+
+	out, err := env.Output(context.Background(), `tty; [ -t 1 ] && echo terminal; read -r x; echo "got $x" >&2`)
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	// The input echoed by the terminal is part of the output.
+	got := string(out)
+	for _, want := range []string{"/dev/pts/", "terminal\r\n", "got hello\r\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Output() = %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestPTYProcessGroup(t *testing.T) {
+	env := NewEnvironment(Sh(), WithPTY(), WithProcessGroup())
+
+	out, err := env.Output(context.Background(), "echo ok")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if string(out) != "ok\r\n" {
+		t.Errorf("Output() = %q, want %q", out, "ok\r\n")
+	}
+}
+
+func TestPTYStream(t *testing.T) {
+	env := NewEnvironment(Bash(), WithPTY())
+
+	var lines []string
+	err := env.Stream(context.Background(), "echo a; echo b", func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+
+	if !slices.Equal(lines, []string{"a", "b"}) {
+		t.Errorf("Stream() lines = %q, want %q", lines, []string{"a", "b"})
+	}
+
+	var objs []string
+	err = env.StreamJSON(context.Background(), `echo '{"a":1}'`, func(obj json.RawMessage) error {
+		objs = append(objs, string(obj))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamJSON() error = %v", err)
+	}
+
+	if !slices.Equal(objs, []string{`{"a":1}`}) {
+		t.Errorf("StreamJSON() objects = %q, want %q", objs, []string{`{"a":1}`})
+	}
+}
+
+func TestPTYPipe(t *testing.T) {
+	env := NewEnvironment(Bash(), WithPTY())
+
+	if _, err := env.Pipe(context.Background(), "echo a", "cat"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Pipe() error = %v, want %v", err, errors.ErrUnsupported)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package sh
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+func attachPTY(cmd *exec.Cmd) (*terminal, error) {
+	return nil, fmt.Errorf("pty: %w", errors.ErrUnsupported)
+}
@@ -1,11 +1,31 @@
 package sh
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/encoding"
 )
 
 // Shell is an interface that describes a Shell
@@ -24,8 +44,128 @@ type Shell interface {
 	Suffix() []string
 }
 
+// EnvProvider can be implemented by a Shell that needs
+// environment variables set to behave predictably.
+//
+// The variables are applied on top of the inherited environment,
+// so they can still be overridden using WithEnv or extra args.
+type EnvProvider interface {
+	Env() map[string]string
+}
+
+// Features that a Shell can report using FeatureReporter.
+const (
+	// FeaturePipefail reports support for "set -o pipefail".
+	FeaturePipefail = "pipefail"
+	// FeatureArrays reports support for array variables.
+	FeatureArrays = "arrays"
+)
+
+// FeatureReporter can be implemented by a Shell
+// to report whether it supports a given feature.
+type FeatureReporter interface {
+	Supports(feature string) bool
+}
+
+// StdinScripter can be implemented by a Shell that can read
+// the script from its standard input.
+type StdinScripter interface {
+	// StdinScriptArgs returns the arguments that make the shell
+	// read the script from its standard input, like -s for bash.
+	// The positional args follow them.
+	StdinScriptArgs() []string
+}
+
+// PositionalFormatter can be implemented by a Shell that does not take
+// positional parameters after an inline script like a POSIX shell,
+// which receives $0 first and then $1, $2 and so on.
+type PositionalFormatter interface {
+	// PositionalArgs returns the arguments passing positional
+	// to the script, following the script and Shell.Suffix().
+	// It returns an error if the shell cannot take them.
+	PositionalArgs(positional []string) ([]string, error)
+}
+
+// SyntaxChecker can be implemented by a Shell that can check
+// the syntax of a script without executing it.
+type SyntaxChecker interface {
+	// SyntaxCheckArgs returns the arguments that make the shell
+	// only parse the script, like -n for bash.
+	SyntaxCheckArgs() []string
+}
+
+// Invocation describes the script passed to an ArgsFormatter.
+type Invocation struct {
+	// Script is the script to run.
+	Script string
+
+	// Env contains the variables set using WithEnv and extra args,
+	// without the variables inherited from the current process.
+	Env []Arg
+
+	// Positional contains the positional parameters.
+	Positional []string
+}
+
+// ArgsFormatter can be implemented by a Shell that needs full control
+// over the arguments passed to its executable, for example to quote
+// the script or to pass environment variables as arguments.
+//
+// When implemented, FormatArgs replaces Shell.Prefix(),
+// the script and Shell.Suffix().
+type ArgsFormatter interface {
+	FormatArgs(inv Invocation) []string
+}
+
 type Option func(*Environment)
 
+func WithStdin(r io.Reader) Option {
+	return func(e *Environment) {
+		e.stdin = r
+	}
+}
+
+// WithStdinFile connects the standard input of the script to f.
+//
+// The script reads f directly, without a goroutine copying its contents.
+// It overrides WithStdin.
+func WithStdinFile(f *os.File) Option {
+	return func(e *Environment) {
+		e.stdinFile = f
+	}
+}
+
+// WithStdoutFile connects the standard output of the script to f.
+//
+// The script writes to f directly, without a goroutine copying the output.
+// It overrides WithStdout and WithCombinedWriter for the standard output.
+func WithStdoutFile(f *os.File) Option {
+	return func(e *Environment) {
+		e.stdoutFile = f
+	}
+}
+
+// WithStderrFile connects the standard error of the script to f.
+//
+// The script writes to f directly, without a goroutine copying the output.
+// It overrides WithStderr and WithCombinedWriter for the standard error.
+func WithStderrFile(f *os.File) Option {
+	return func(e *Environment) {
+		e.stderrFile = f
+	}
+}
+
+// WithInheritStdin connects the standard input of the script
+// to the standard input of the current process.
+//
+// By default, the script reads from the null device, so commands
+// reading their input see end of file instead of waiting for it.
+func WithInheritStdin() Option {
+	return func(e *Environment) {
+		e.stdin = os.Stdin
+	}
+}
+
 func WithStdout(w io.Writer) Option {
 	return func(e *Environment) {
 		e.stdout = w
@@ -38,175 +178,3116 @@ func WithStderr(w io.Writer) Option {
 	}
 }
 
-func WithEnv(env map[string]string) Option {
+// WithDiscardOutput discards the standard output and standard error
+// of the script, replacing the writers set using WithStdout, WithStderr
+// and WithCombinedWriter.
+//
+// Output and similar methods still return the output they collect.
+func WithDiscardOutput() Option {
 	return func(e *Environment) {
-		e.env = env
+		e.stdout = io.Discard
+		e.stderr = io.Discard
+		e.combined = nil
 	}
 }
 
-func WithWorkingDir(dir string) Option {
+// WithScanBufferSize sets the maximum length of a line
+// delivered by Stream and StreamBoth to n bytes.
+//
+// Longer lines make the streaming methods fail with bufio.ErrTooLong.
+// The default is bufio.MaxScanTokenSize.
+func WithScanBufferSize(n int) Option {
 	return func(e *Environment) {
-		e.workingDir = dir
+		e.scanBufferSize = n
 	}
 }
 
-// Environment is a struct that describes the Environment
-// in which the shell is executed.
-type Environment struct {
-	// shell is the shell to use.
-	shell Shell
+// WithBufferPool sets the pool of *bytes.Buffer used to collect
+// the output of Output, CombinedOutput, Result and similar methods.
+//
+// The returned output is copied out of the pooled buffers, so it stays
+// valid after the buffers are reused. By default, a pool shared
+// by all environments is used.
+func WithBufferPool(pool *sync.Pool) Option {
+	return func(e *Environment) {
+		e.bufferPool = pool
+	}
+}
+
+// WithTailBuffer retains the last n bytes of the standard output
+// and standard error of the script, for diagnosing failures
+// of long running scripts without keeping all of their output.
+//
+// The retained output is available using ExitError.Tail and Process.Tail.
+func WithTailBuffer(n int) Option {
+	return func(e *Environment) {
+		e.tailSize = n
+	}
+}
 
-	stdout     io.Writer
-	stderr     io.Writer
-	env        map[string]string
-	workingDir string
+// WithCombinedWriter writes both standard output and standard error
+// of the script to w, in the order they are produced.
+//
+// Writers set using WithStdout and WithStderr still receive
+// their respective streams in addition to w.
+func WithCombinedWriter(w io.Writer) Option {
+	return func(e *Environment) {
+		e.combined = w
+	}
+}
 
-	argBuffer []string
+// WithOutputLimit limits the number of bytes collected by Output,
+// CombinedOutput, Result and similar methods to n.
+// Result limits each of the standard output and standard error.
+//
+// When the limit is exceeded, the script is killed and ErrOutputTooLarge
+// is returned along with the first n bytes of the output.
+// Zero means no limit.
+func WithOutputLimit(n int64) Option {
+	return func(e *Environment) {
+		e.outputLimit = n
+	}
 }
 
-func NewEnvironment(shell Shell, opts ...Option) *Environment {
-	env := &Environment{
-		shell: shell,
+func WithEnv(env map[string]string) Option {
+	return func(e *Environment) {
+		e.env = env
 	}
+}
 
-	for _, opt := range opts {
-		opt(env)
+// WithEnvFile loads environment variables from the dotenv file at path.
+//
+// The file is read every time a script is run, and an error is returned
+// if it cannot be parsed. Each line has the form KEY=VALUE, optionally
+// preceded by "export". Values can be enclosed in single or double quotes,
+// and lines starting with # are ignored. Variables set using WithEnv
+// and the extra args take precedence over the ones in the file.
+func WithEnvFile(path string) Option {
+	return func(e *Environment) {
+		e.envFiles = append(e.envFiles, path)
 	}
+}
 
-	return env
+// WithEnvFunc sets environment variables computed by fn
+// every time a script is run, right before it is started.
+//
+// The variables override the ones set using WithEnv, and are overridden
+// by the extra args. If fn returns an error, the script is not run.
+func WithEnvFunc(fn func(ctx context.Context) (map[string]string, error)) Option {
+	return func(e *Environment) {
+		e.envFunc = fn
+	}
 }
 
-// Run runs the script in the environment
+// WithTraceEnv sets the variable key to the value returned by extract
+// for the context passed to Run and the other methods, like a trace ID.
 //
-// Run uses shell as a command
-// Arguments passed to the exec.Cmd are:
-// 1. Shell.Prefix()...
-// 2. script
-// 3. Shell.Suffix()...
+// The variable is not set if extract returns an empty string.
+func WithTraceEnv(key string, extract func(ctx context.Context) string) Option {
+	return func(e *Environment) {
+		e.traceEnv = append(e.traceEnv, traceEnv{key: key, extract: extract})
+	}
+}
+
+type traceEnv struct {
+	key     string
+	extract func(ctx context.Context) string
+}
+
+// WithPathPrepend adds dirs to the beginning of the PATH
+// seen by the script, so they are searched first.
 //
-// Extra args are passed as environment variables
-func (e *Environment) Run(ctx context.Context, script string, args ...any) error {
-	defer e.cleanup()
+// The PATH is the one set using WithEnv or WithEnvFile,
+// or the PATH of the current process.
+func WithPathPrepend(dirs ...string) Option {
+	return func(e *Environment) {
+		e.pathPrepend = append(e.pathPrepend, dirs...)
+	}
+}
 
-	cmd, err := e.command(ctx, script, args...)
-	if err != nil {
-		return err
+// WithPathAppend adds dirs to the end of the PATH
+// seen by the script, so they are searched last.
+//
+// The PATH is the one set using WithEnv or WithEnvFile,
+// or the PATH of the current process.
+func WithPathAppend(dirs ...string) Option {
+	return func(e *Environment) {
+		e.pathAppend = append(e.pathAppend, dirs...)
 	}
+}
 
-	return cmd.Run()
+// WithTimeout limits the time the script is allowed to run.
+//
+// When the timeout expires, the script is killed and the returned error
+// wraps context.DeadlineExceeded. Zero means no timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(e *Environment) {
+		e.timeout = d
+	}
 }
 
-func (e *Environment) Output(ctx context.Context, script string, args ...any) ([]byte, error) {
-	defer e.cleanup()
+// WithStartTimeout limits the time it takes to start the script,
+// including preparing the command and forking the shell.
+//
+// Once the script is started, the timeout no longer applies and
+// WithTimeout limits the time the script runs. If the script does not
+// start in time, the returned error wraps ErrStartTimeout. Zero means
+// no timeout.
+func WithStartTimeout(d time.Duration) Option {
+	return func(e *Environment) {
+		e.startTimeout = d
+	}
+}
 
-	cmd, err := e.command(ctx, script, args...)
-	if err != nil {
-		return nil, err
+// WithCleanEnv runs the script without inheriting the environment
+// of the current process.
+//
+// Only variables set using WithEnv and the extra args are visible to the script.
+func WithCleanEnv() Option {
+	return func(e *Environment) {
+		e.cleanEnv = true
 	}
+}
 
-	return cmd.Output()
+// WithInheritOnly runs the script inheriting only the variables
+// named by keys from the environment of the current process.
+//
+// Variables set using WithEnv and the extra args are passed as usual.
+func WithInheritOnly(keys ...string) Option {
+	return func(e *Environment) {
+		e.inheritOnly = append([]string{}, keys...)
+	}
 }
 
-func (e *Environment) cleanup() {
-	e.argBuffer = e.argBuffer[:0]
+// WithRawEnv uses env, a list of KEY=VALUE pairs, as the environment
+// of the script instead of the environment of the current process.
+//
+// Variables set using WithEnv, WithEnvFile and the extra args
+// are added to env, overriding its values. WithRawEnv takes precedence
+// over WithCleanEnv and WithInheritOnly, so env is used even with them.
+func WithRawEnv(env []string) Option {
+	return func(e *Environment) {
+		e.rawEnv = append([]string{}, env...)
+	}
 }
 
-func (e *Environment) command(ctx context.Context, script string, args ...any) (*exec.Cmd, error) {
-	e.argBuffer = append(e.argBuffer, e.shell.Prefix()...)
-	e.argBuffer = append(e.argBuffer, script)
-	if suf := e.shell.Suffix(); len(suf) > 0 {
-		e.argBuffer = append(e.argBuffer, suf...)
+// WithExpandArgs expands references to variables, like $HOME or ${HOME},
+// in the values of the extra args before passing them to the script.
+//
+// The references are resolved using the environment of the script,
+// including the extra args preceding the expanded one.
+// Unset variables expand to the empty string.
+func WithExpandArgs() Option {
+	return func(e *Environment) {
+		e.expandArgs = true
 	}
+}
 
-	cmd := exec.CommandContext(ctx, e.shell.Name(), e.argBuffer...)
-	cmd.Stdout = e.stdout
-	cmd.Stderr = e.stderr
+// WithUnsetEnv removes the variables named by keys from the
+// environment of the script, even if they are inherited from
+// the current process or set using the other options and extra args.
+func WithUnsetEnv(keys ...string) Option {
+	return func(e *Environment) {
+		e.unsetEnv = append(e.unsetEnv, keys...)
+	}
+}
 
-	if e.workingDir != "" {
-		cmd.Dir = e.workingDir
+// WithBeforeRun registers a hook that is called with the fully
+// assembled command right before it is started.
+//
+// The hook can be used to log the command or adjust attributes
+// not exposed by the package.
+func WithBeforeRun(fn func(cmd *exec.Cmd)) Option {
+	return func(e *Environment) {
+		e.beforeRun = fn
 	}
+}
 
-	envs := os.Environ()
-	if len(e.env) > 0 {
-		for k, v := range e.env {
-			envs = append(envs, k+"="+v)
-		}
+// WithCaptureStderrOnError collects the standard error of the script
+// and includes it in the returned error when the script fails.
+//
+// The collected output is available using ExitError.Stderr.
+// Only the first and the last 32KB of it are kept.
+//
+// If stdout and stderr share a writer, for example with CombinedOutput,
+// they are read from separate pipes to tell them apart, so lines written
+// to both at about the same time may be reordered.
+// Writers configured using WithStderr still receive the output.
+func WithCaptureStderrOnError() Option {
+	return func(e *Environment) {
+		e.captureStderr = true
 	}
+}
 
-	for i := 0; i < len(args); i++ {
-		switch v := args[i].(type) {
-		case Arg:
-			envs = append(envs, v.String())
-		default:
-			if i == len(args)-1 {
-				return nil, fmt.Errorf("invalid number of arguments")
-			}
-			key := fmt.Sprintf("%v", args[i])
-			val := fmt.Sprintf("%v", args[i+1])
-			envs = append(envs, key+"="+val)
-			i++
-		}
+// WithForwardSignals relays sigs received by the current process
+// to the script while it is running.
+//
+// While the script is running, the current process is not terminated
+// by the forwarded signals.
+//
+// On Unix, the script is started in its own process group and the
+// signals are sent to the whole group, so they also reach the processes
+// started by the script. The group is not the foreground process group
+// of the terminal, so a script reading from the terminal is stopped;
+// use WithPTY for interactive scripts. On Windows, the signals are only
+// sent to the process running the script.
+func WithForwardSignals(sigs ...os.Signal) Option {
+	return func(e *Environment) {
+		e.forwardSignals = sigs
 	}
-	cmd.Env = envs
+}
 
-	return cmd, nil
+// WithProcessGroup starts the script in its own process group.
+//
+// When the context is cancelled or the timeout expires,
+// the whole process group is killed, including the processes
+// started by the script in the background.
+//
+// Process groups are only supported on Unix.
+func WithProcessGroup() Option {
+	return func(e *Environment) {
+		e.processGroup = true
+	}
 }
 
-type Arg struct {
-	Key   string
-	Value string
+// WithPTY attaches the script to a new pseudo-terminal, so it behaves
+// as if run interactively, for example printing colors or prompts.
+//
+// The output written to the terminal, including the standard error,
+// is delivered as the standard output of the script, and the configured
+// stdin is written to the terminal. The terminal echoes its input
+// and translates newlines to "\r\n". Pipe does not support it.
+//
+// Pseudo-terminals are only supported on Linux.
+func WithPTY() Option {
+	return func(e *Environment) {
+		e.pty = true
+	}
 }
 
-func (kv Arg) String() string {
-	return kv.Key + "=" + kv.Value
+// WithCgroupLimits runs the script in a new cgroup v2 group, created
+// for each run under the cgroup of the current process, limiting the CPU
+// time and the memory the script and its children can use.
+//
+// cpuQuota is the CPU time allowed in every 100ms period, so 50ms limits
+// the script to half a CPU and 200ms to two CPUs. memBytes is the memory
+// limit in bytes, and the script is killed if it exceeds it.
+// A zero value leaves the corresponding resource unlimited.
+//
+// The group is removed after the script exits, killing the processes
+// left in it. Cgroups are only supported on Linux.
+//
+// The current process needs write access to its cgroup, for example as
+// root in a container or in a systemd unit with Delegate=yes. A cgroup
+// with processes cannot enable controllers for its children, so unless
+// the controllers are already enabled or it is the root group, the run
+// fails until the current process is moved out using MoveToCgroupLeaf.
+func WithCgroupLimits(cpuQuota time.Duration, memBytes int64) Option {
+	return func(e *Environment) {
+		e.cgroupLimits = &cgroupLimits{cpuQuota: cpuQuota, memBytes: memBytes}
+	}
 }
 
-func Bash() Shell {
-	return &bash{}
+// WithSysProcAttr sets the OS specific attributes of the process
+// running the script.
+//
+// The attributes are copied, and options like WithProcessGroup
+// and WithCredential are applied on top of them.
+func WithSysProcAttr(attr *syscall.SysProcAttr) Option {
+	return func(e *Environment) {
+		e.sysProcAttr = attr
+	}
 }
 
-func Sh() Shell {
-	return &sh{}
+// WithShellArgs passes extra arguments to the shell binary,
+// before Shell.Prefix() and the script.
+//
+// For example, WithShellArgs("-e") runs bash as "bash -e -c script".
+func WithShellArgs(args ...string) Option {
+	return func(e *Environment) {
+		e.shellArgs = args
+	}
+}
+
+// WithCancelGrace terminates the script gracefully when the context
+// is cancelled or the timeout expires.
+//
+// The script is first sent SIGTERM, and if it does not exit within
+// the grace period, it is killed. On platforms without SIGTERM,
+// the script is killed right away.
+//
+// With WithProcessGroup, the whole group is killed after the grace
+// period, unless the script has exited and been waited for by then.
+func WithCancelGrace(d time.Duration) Option {
+	return func(e *Environment) {
+		e.cancelGrace = d
+	}
 }
 
-type bash struct{}
+// WithStrictMode makes the script exit on the first failing command
+// and on use of unset variables.
+//
+// It prepends "set -euo pipefail; " to inline scripts for shells supporting
+// FeaturePipefail, and "set -eu; " for other shells implementing FeatureReporter.
+// Scripts run by shells that do not implement FeatureReporter are left unchanged.
+func WithStrictMode() Option {
+	return func(e *Environment) {
+		e.strictMode = true
+	}
+}
 
-func (b *bash) Name() string {
-	return "bash"
+// WithLogger logs every command executed in the environment to l.
+//
+// A record is logged before the command starts, with the shell, the script
+// and the extra args, and after it finishes, with its duration, exit code and error.
+// Values of the extra args are redacted unless WithLogArgValues is used.
+func WithLogger(l *slog.Logger) Option {
+	return func(e *Environment) {
+		e.logger = l
+	}
 }
 
-func (b *bash) Prefix() []string {
-	return []string{"-c"}
+// WithSuccessCodes treats the non-zero exit codes as success,
+// for tools like diff and grep that exit with 1 without failing.
+func WithSuccessCodes(codes ...int) Option {
+	return func(e *Environment) {
+		e.successCodes = codes
+	}
 }
 
-func (b *bash) Suffix() []string {
-	return nil
+// WithOnExit calls fn with the exit code and the error of each script
+// once it finishes, whether it succeeds or fails.
+//
+// The exit code is -1 if the script did not start or was killed by a signal.
+func WithOnExit(fn func(code int, err error)) Option {
+	return func(e *Environment) {
+		e.onExit = fn
+	}
 }
 
-var defaultEnvironment = NewEnvironment(&bash{})
+// WithTimingCallback calls fn with the time each script
+// took to run, once it exits.
+func WithTimingCallback(fn func(d time.Duration)) Option {
+	return func(e *Environment) {
+		e.onTiming = fn
+	}
+}
 
-func SetDefaultEnvironment(env *Environment) {
-	defaultEnvironment = env
+// WithLogArgValues logs the values of the extra args
+// instead of redacting them.
+func WithLogArgValues() Option {
+	return func(e *Environment) {
+		e.logArgValues = true
+	}
 }
 
-func Run(ctx context.Context, script string, args ...any) error {
-	return defaultEnvironment.Run(ctx, script, args...)
+func WithWorkingDir(dir string) Option {
+	return func(e *Environment) {
+		e.workingDir = dir
+	}
 }
 
-func Output(ctx context.Context, script string, args ...any) ([]byte, error) {
-	return defaultEnvironment.Output(ctx, script, args...)
+// Environment is a struct that describes the Environment
+// in which the shell is executed.
+type Environment struct {
+	// shell is the shell to use.
+	shell Shell
+
+	stdin          io.Reader
+	stdout         io.Writer
+	stderr         io.Writer
+	stdinFile      *os.File
+	stdoutFile     *os.File
+	stderrFile     *os.File
+	captureStderr  bool
+	combined       io.Writer
+	outputLimit    int64
+	tailSize       int
+	scanBufferSize int
+	bufferPool     *sync.Pool
+	env            map[string]string
+	envFiles       []string
+	envFunc        func(ctx context.Context) (map[string]string, error)
+	traceEnv       []traceEnv
+	pathPrepend    []string
+	pathAppend     []string
+	cleanEnv       bool
+	inheritOnly    []string
+	rawEnv         []string
+	expandArgs     bool
+	unsetEnv       []string
+	workingDir     string
+	timeout        time.Duration
+	startTimeout   time.Duration
+	cancelGrace    time.Duration
+	beforeRun      func(cmd *exec.Cmd)
+	forwardSignals []os.Signal
+	processGroup   bool
+	pty            bool
+	cgroupLimits   *cgroupLimits
+	sysProcAttr    *syscall.SysProcAttr
+	shellArgs      []string
+	strictMode     bool
+	successCodes   []int
+	umask          string
+	credential     *credential
+	logger         *slog.Logger
+	logArgValues   bool
+	onTiming       func(d time.Duration)
+	onExit         func(code int, err error)
+
+	argBuffer []string
+	writers   []*checkedWriter
+	ptyPipe   *io.PipeWriter
+	stopGrace func()
 }
 
-type sh struct{}
+func NewEnvironment(shell Shell, opts ...Option) *Environment {
+	env := &Environment{
+		shell: shell,
+	}
 
-func (s *sh) Name() string {
-	return "sh"
+	for _, opt := range opts {
+		opt(env)
+	}
+
+	return env
 }
 
-func (s *sh) Prefix() []string {
-	return []string{"-c"}
+// NewEnvironmentStrict is like NewEnvironment, but returns an error
+// if the shell executable cannot be found, instead of failing
+// when a script is run.
+func NewEnvironmentStrict(shell Shell, opts ...Option) (*Environment, error) {
+	env := NewEnvironment(shell, opts...)
+	if _, err := env.ResolveShell(); err != nil {
+		return nil, err
+	}
+	return env, nil
 }
 
-func (s *sh) Suffix() []string {
-	return nil
+// Run runs the script in the environment
+//
+// Run uses shell as a command
+// Arguments passed to the exec.Cmd are:
+// 1. extra shell arguments set using WithShellArgs...
+// 2. Shell.Prefix()...
+// 3. script
+// 4. Shell.Suffix()...
+//
+// Extra args are passed as environment variables,
+// except for Positional args which are passed after the script.
+// An extra arg can be a key followed by its value, an Arg, a SecretArg,
+// or a map[string]string holding several variables.
+func (e *Environment) Run(ctx context.Context, script string, args ...any) error {
+	return e.run(ctx, source{script: script}, args)
+}
+
+// RunFile runs the script file at path in the environment.
+//
+// The path is passed to the shell in place of the script,
+// without the trailing "-c" of Shell.Prefix(), so the shell reads
+// the script from the file and reports errors with correct line numbers.
+func (e *Environment) RunFile(ctx context.Context, path string, args ...any) error {
+	return e.run(ctx, source{script: path, file: true}, args)
+}
+
+// RunArgs runs the script like Run, passing args as environment
+// variables, so the key and value pairing is checked at compile time.
+func (e *Environment) RunArgs(ctx context.Context, script string, args ...Arg) error {
+	anyArgs := make([]any, len(args))
+	for i, arg := range args {
+		anyArgs[i] = arg
+	}
+	return e.Run(ctx, script, anyArgs...)
+}
+
+// RunReader runs the script read from r in the environment,
+// without reading it into memory first.
+//
+// The shell reads the script from its standard input, so the script
+// cannot read the configured stdin. The shell must implement StdinScripter.
+func (e *Environment) RunReader(ctx context.Context, r io.Reader, args ...any) error {
+	return e.run(ctx, source{stdin: r}, args)
+}
+
+// RunWith runs the script like Run, applying opts
+// to a copy of the environment for this call only.
+func (e *Environment) RunWith(ctx context.Context, script string, opts []Option, args ...any) error {
+	return e.with(opts).Run(ctx, script, args...)
+}
+
+// RunEnv runs the script like Run, passing env as extra args.
+func (e *Environment) RunEnv(ctx context.Context, script string, env map[string]string) error {
+	return e.Run(ctx, script, mapArgs(env)...)
+}
+
+// RunStruct runs the script like Run, passing the exported fields
+// of v as environment variables.
+//
+// v must be a struct or a pointer to a struct. The variable name is taken
+// from the field's `sh:"NAME"` tag, defaulting to the field name.
+// Fields tagged `sh:"-"` are skipped. Values are formatted like NewArg.
+// Extra args are applied after the fields and override them.
+func (e *Environment) RunStruct(ctx context.Context, script string, v any, args ...any) error {
+	fields, err := structArgs(v)
+	if err != nil {
+		return err
+	}
+	return e.Run(ctx, script, append(fields, args...)...)
+}
+
+func structArgs(v any) ([]any, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected a struct, got %T", v)
+	}
+
+	rt := rv.Type()
+	args := make([]any, 0, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("sh"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+
+		args = append(args, NewArg(name, rv.Field(i).Interface()))
+	}
+
+	return args, nil
+}
+
+// RunAll runs the scripts in the environment one after another,
+// stopping at the first one that fails.
+//
+// The returned error reports the index of the failed script.
+func (e *Environment) RunAll(ctx context.Context, scripts ...string) error {
+	for i, script := range scripts {
+		if err := e.Run(ctx, script); err != nil {
+			return fmt.Errorf("script %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// RunParallel runs the scripts in the environment concurrently,
+// at most maxConcurrency at a time, and waits for them to finish.
+// Zero or less means no limit.
+//
+// Each script runs in a clone of the environment. The returned error
+// joins the errors of all failed scripts. When the context is done,
+// the scripts that have not started yet are not run.
+func (e *Environment) RunParallel(ctx context.Context, maxConcurrency int, scripts ...string) error {
+	if maxConcurrency <= 0 {
+		maxConcurrency = len(scripts)
+	}
+
+	sem := make(chan struct{}, maxConcurrency)
+	errs := make([]error, len(scripts))
+	var wg sync.WaitGroup
+	for i, script := range scripts {
+		if err := ctx.Err(); err != nil {
+			errs[i] = fmt.Errorf("script %d: %w", i, err)
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = fmt.Errorf("script %d: %w", i, ctx.Err())
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, env *Environment, script string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := env.Run(ctx, script); err != nil {
+				errs[i] = fmt.Errorf("script %d: %w", i, err)
+			}
+		}(i, e.Clone(), script)
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// RunTemplate executes the text/template tmpl with data
+// and runs the result like Run.
+//
+// The template can use the quote function to quote values using Quote,
+// as in "echo {{ .Name | quote }}", so they are passed as a single word.
+func (e *Environment) RunTemplate(ctx context.Context, tmpl string, data any, args ...any) error {
+	t, err := template.New("script").Funcs(template.FuncMap{"quote": Quote}).Parse(tmpl)
+	if err != nil {
+		return err
+	}
+
+	var script strings.Builder
+	if err := t.Execute(&script, data); err != nil {
+		return err
+	}
+
+	return e.Run(ctx, script.String(), args...)
+}
+
+// RetryPolicy configures Environment.RunWithRetry.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times the script is run.
+	// Values less than 1 are treated as 1.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the second attempt.
+	// The delay doubles after each failed attempt.
+	BaseDelay time.Duration
+
+	// ShouldRetry reports whether the script should be run again
+	// after failing with err. If nil, all failures are retried.
+	ShouldRetry func(err error) bool
+}
+
+// RunWithRetry runs the script like Run, running it again
+// according to policy while it fails.
+//
+// The context is checked between attempts, and the last error is returned.
+func (e *Environment) RunWithRetry(ctx context.Context, script string, policy RetryPolicy, args ...any) error {
+	delay := policy.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := e.Run(ctx, script, args...)
+		if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		if policy.ShouldRetry != nil && !policy.ShouldRetry(err) {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// RunInDir runs the script like Run, using dir as the
+// working directory for this call only.
+func (e *Environment) RunInDir(ctx context.Context, dir, script string, args ...any) error {
+	return e.RunWith(ctx, script, []Option{WithWorkingDir(dir)}, args...)
+}
+
+// Start starts the script in the environment without waiting for it to complete.
+//
+// The returned Process must be waited on using Process.Wait
+// to release associated resources.
+func (e *Environment) Start(ctx context.Context, script string, args ...any) (*Process, error) {
+	return e.start(ctx, source{script: script}, args, nil)
+}
+
+func (e *Environment) Output(ctx context.Context, script string, args ...any) ([]byte, error) {
+	return e.output(ctx, source{script: script}, args)
+}
+
+// OutputFile runs the script file at path like RunFile
+// and returns its standard output.
+func (e *Environment) OutputFile(ctx context.Context, path string, args ...any) ([]byte, error) {
+	return e.output(ctx, source{script: path, file: true}, args)
+}
+
+func (e *Environment) run(ctx context.Context, src source, args []any) error {
+	p, err := e.start(ctx, src, args, nil)
+	if err != nil {
+		return err
+	}
+
+	return p.Wait()
+}
+
+func (e *Environment) output(ctx context.Context, src source, args []any) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stdout := e.outputBuffer(cancel)
+	p, err := e.start(ctx, src, args, func(cmd *exec.Cmd) error {
+		cmd.Stdout = stdout
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stdout.result(p.Wait())
+}
+
+// OutputWith runs the script like Output, applying opts
+// to a copy of the environment for this call only.
+func (e *Environment) OutputWith(ctx context.Context, script string, opts []Option, args ...any) ([]byte, error) {
+	return e.with(opts).Output(ctx, script, args...)
+}
+
+// OutputEnv runs the script like Output, passing env as extra args.
+func (e *Environment) OutputEnv(ctx context.Context, script string, env map[string]string) ([]byte, error) {
+	return e.Output(ctx, script, mapArgs(env)...)
+}
+
+// OutputStderr runs the script in the environment and returns
+// its standard output and standard error separately.
+//
+// Writers configured using WithStdout and WithStderr are ignored.
+func (e *Environment) OutputStderr(ctx context.Context, script string, args ...any) (stdout []byte, stderr []byte, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	outBuf := e.outputBuffer(cancel)
+	errBuf := e.outputBuffer(cancel)
+	p, err := e.start(ctx, source{script: script}, args, func(cmd *exec.Cmd) error {
+		cmd.Stdout = outBuf
+		cmd.Stderr = errBuf
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = p.Wait()
+	stdout, outErr := outBuf.result(err)
+	stderr, errErr := errBuf.result(err)
+	if errors.Is(errErr, ErrOutputTooLarge) {
+		outErr = errErr
+	}
+	return stdout, stderr, outErr
+}
+
+// OutputLines runs the script in the environment and returns
+// its standard output split into records ending with sep,
+// like '\n' for lines or 0 for the output of find -print0.
+//
+// The empty record following a trailing separator is dropped.
+func (e *Environment) OutputLines(ctx context.Context, script string, sep byte, args ...any) ([]string, error) {
+	out, err := e.Output(ctx, script, args...)
+	if len(out) == 0 {
+		return nil, err
+	}
+
+	out = bytes.TrimSuffix(out, []byte{sep})
+	return strings.Split(string(out), string(sep)), err
+}
+
+// OutputJSON runs the script in the environment and decodes
+// its standard output as JSON into v.
+//
+// If the output cannot be decoded, the returned error includes it.
+func (e *Environment) OutputJSON(ctx context.Context, v any, script string, args ...any) error {
+	out, err := e.Output(ctx, script, args...)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(out, v); err != nil {
+		return fmt.Errorf("decoding output %q: %w", out, err)
+	}
+	return nil
+}
+
+// OutputCode runs the script in the environment and returns
+// its standard output and exit code.
+//
+// Like Result, a non-zero exit code is not treated as an error.
+// The returned error is non-nil only if the script could not be run
+// to completion, in which case the exit code is -1.
+func (e *Environment) OutputCode(ctx context.Context, script string, args ...any) ([]byte, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stdout := e.outputBuffer(cancel)
+	p, err := e.start(ctx, source{script: script}, args, func(cmd *exec.Cmd) error {
+		cmd.Stdout = stdout
+		return nil
+	})
+	if err != nil {
+		return nil, -1, err
+	}
+
+	out, err := stdout.result(p.Wait())
+	code := p.cmd.ProcessState.ExitCode()
+
+	var exitErr ExitError
+	if errors.As(err, &exitErr) && p.ctx.Err() == nil {
+		return out, code, nil
+	}
+	if err != nil {
+		return out, -1, err
+	}
+	return out, code, nil
+}
+
+// OutputString runs the script in the environment and returns
+// its standard output as a string with trailing newlines removed.
+func (e *Environment) OutputString(ctx context.Context, script string, args ...any) (string, error) {
+	out, err := e.Output(ctx, script, args...)
+	return strings.TrimRight(string(out), "\n"), err
+}
+
+// OutputDecoded runs the script in the environment and returns its
+// standard output converted from enc to UTF-8, for scripts running
+// tools that write text in other encodings, like UTF-16 or Windows-1252.
+func (e *Environment) OutputDecoded(ctx context.Context, enc encoding.Encoding, script string, args ...any) (string, error) {
+	out, err := e.Output(ctx, script, args...)
+
+	decoded, decodeErr := enc.NewDecoder().Bytes(out)
+	if decodeErr != nil && err == nil {
+		err = fmt.Errorf("decoding output: %w", decodeErr)
+	}
+
+	return string(decoded), err
+}
+
+// CombinedOutput runs the script in the environment and returns
+// its combined standard output and standard error.
+//
+// Writers configured using WithStdout and WithStderr are ignored.
+func (e *Environment) CombinedOutput(ctx context.Context, script string, args ...any) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	out := e.outputBuffer(cancel)
+	p, err := e.start(ctx, source{script: script}, args, func(cmd *exec.Cmd) error {
+		cmd.Stdout = out
+		cmd.Stderr = out
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.result(p.Wait())
+}
+
+// Result is the outcome of a script run using Environment.Result.
+type Result struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+
+	// Duration is the time the script took to run.
+	Duration time.Duration
+}
+
+// Result runs the script in the environment and returns its
+// standard output, standard error and exit code.
+//
+// Unlike Run, a non-zero exit code is not treated as an error.
+// The returned error is non-nil only if the script could not be run
+// to completion, for example when it fails to start or the context is done.
+//
+// Writers configured using WithStdout and WithStderr are ignored.
+// Each stream is limited by WithOutputLimit, like Output.
+func (e *Environment) Result(ctx context.Context, script string, args ...any) (*Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	outBuf := e.outputBuffer(cancel)
+	errBuf := e.outputBuffer(cancel)
+	p, err := e.start(ctx, source{script: script}, args, func(cmd *exec.Cmd) error {
+		cmd.Stdout = outBuf
+		cmd.Stderr = errBuf
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.Wait()
+	stdout, outErr := outBuf.result(err)
+	stderr, errErr := errBuf.result(err)
+	result := &Result{
+		Stdout:   stdout,
+		Stderr:   stderr,
+		ExitCode: p.cmd.ProcessState.ExitCode(),
+		Duration: p.duration,
+	}
+
+	for _, err := range []error{outErr, errErr} {
+		if errors.Is(err, ErrOutputTooLarge) {
+			return result, err
+		}
+	}
+
+	var exitErr ExitError
+	if errors.As(err, &exitErr) && p.ctx.Err() == nil {
+		return result, nil
+	}
+
+	return result, err
+}
+
+// Pipe runs the scripts in the environment, connecting the standard
+// output of each script to the standard input of the next one,
+// and returns the standard output of the last script.
+//
+// The first script reads from the configured stdin.
+// If any of the scripts fails, the error reports which one.
+// A script other than the last one killed by SIGPIPE, or exiting with
+// status 141 after its command was, is not a failure, since it only means
+// a later script exited without reading all of its input.
+//
+// Pipe does not support WithPTY.
+func (e *Environment) Pipe(ctx context.Context, scripts ...string) ([]byte, error) {
+	if len(scripts) == 0 {
+		return nil, errors.New("pipe: no scripts")
+	}
+	if e.pty {
+		return nil, fmt.Errorf("pipe: pty: %w", errors.ErrUnsupported)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var out bytes.Buffer
+	var pipe io.ReadCloser
+	procs := make([]*Process, 0, len(scripts))
+	for i, script := range scripts {
+		last := i == len(scripts)-1
+		stdin := e.stdin
+		if pipe != nil {
+			stdin = pipe
+		}
+
+		var stdout io.ReadCloser
+		p, err := e.start(ctx, source{script: script}, nil, func(cmd *exec.Cmd) error {
+			cmd.Stdin = stdin
+			if last {
+				cmd.Stdout = &out
+				return nil
+			}
+			var err error
+			stdout, err = cmd.StdoutPipe()
+			return err
+		})
+
+		// The read end of the previous pipe is inherited by this stage,
+		// so it must be closed here for the previous stage to get SIGPIPE
+		// if this stage exits early.
+		if pipe != nil {
+			pipe.Close()
+		}
+
+		if err != nil {
+			cancel()
+			for _, p := range procs {
+				p.Wait()
+			}
+			return nil, fmt.Errorf("pipe stage %d: %w", i, err)
+		}
+		procs = append(procs, p)
+		pipe = stdout
+	}
+
+	var errs []error
+	for i, p := range procs {
+		err := p.Wait()
+		if i < len(procs)-1 && isBrokenPipe(err) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pipe stage %d: %w", i, err))
+		}
+	}
+
+	return out.Bytes(), errors.Join(errs...)
+}
+
+// Stream runs the script in the environment and calls onLine
+// for each line the script writes to its standard output.
+//
+// onLine is called synchronously while the script is running,
+// without the trailing newline.
+func (e *Environment) Stream(ctx context.Context, script string, onLine func(line string), args ...any) error {
+	var stdout io.ReadCloser
+	p, err := e.start(ctx, source{script: script}, args, func(cmd *exec.Cmd) error {
+		var err error
+		stdout, err = e.stdoutPipe(cmd)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	scanner := e.newScanner(stdout)
+	for scanner.Scan() {
+		onLine(scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		// Close the pipe so the script does not block writing to it.
+		stdout.Close()
+		p.Wait()
+		return err
+	}
+
+	return p.Wait()
+}
+
+// StreamJSON runs the script in the environment and calls onObj
+// for each line of JSON the script writes to its standard output.
+//
+// Empty lines are skipped. If a line is not valid JSON or onObj
+// returns an error, the script is killed and the error is returned.
+func (e *Environment) StreamJSON(ctx context.Context, script string, onObj func(obj json.RawMessage) error, args ...any) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var stdout io.ReadCloser
+	p, err := e.start(ctx, source{script: script}, args, func(cmd *exec.Cmd) error {
+		var err error
+		stdout, err = e.stdoutPipe(cmd)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var streamErr error
+	scanner := e.newScanner(stdout)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			streamErr = fmt.Errorf("line %d of the output is not valid JSON", n)
+			break
+		}
+		if err := onObj(bytes.Clone(line)); err != nil {
+			streamErr = err
+			break
+		}
+	}
+	if streamErr == nil {
+		streamErr = scanner.Err()
+	}
+
+	if streamErr != nil {
+		cancel()
+		stdout.Close()
+		p.Wait()
+		return streamErr
+	}
+
+	return p.Wait()
+}
+
+// StreamBoth runs the script in the environment and calls onStdout
+// and onStderr for each line the script writes to its standard output
+// and standard error respectively.
+//
+// The streams are read concurrently, so the callbacks may be called
+// from different goroutines, but lines of each stream are delivered in order.
+func (e *Environment) StreamBoth(ctx context.Context, script string, onStdout, onStderr func(line string), args ...any) error {
+	outR, outW := io.Pipe()
+	errR, errW := io.Pipe()
+	p, err := e.start(ctx, source{script: script}, args, func(cmd *exec.Cmd) error {
+		cmd.Stdout = outW
+		cmd.Stderr = errW
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	scanErrs := make([]error, 2)
+	scan := func(i int, r *io.PipeReader, onLine func(string)) {
+		defer wg.Done()
+		scanner := e.newScanner(r)
+		for scanner.Scan() {
+			onLine(scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			// Fail the writes so the script does not block on the stream.
+			r.CloseWithError(err)
+			scanErrs[i] = err
+		}
+	}
+
+	wg.Add(2)
+	go scan(0, outR, onStdout)
+	go scan(1, errR, onStderr)
+
+	err = p.Wait()
+	outW.Close()
+	errW.Close()
+	wg.Wait()
+
+	if scanErr := errors.Join(scanErrs...); scanErr != nil {
+		return scanErr
+	}
+	return err
+}
+
+// stdoutPipe returns a pipe connected to the standard output of cmd.
+//
+// With WithPTY, the output of the terminal is copied to the pipe,
+// which is closed once the terminal is, as the write end
+// of cmd.StdoutPipe is closed when the script is started.
+func (e *Environment) stdoutPipe(cmd *exec.Cmd) (io.ReadCloser, error) {
+	if !e.pty {
+		return cmd.StdoutPipe()
+	}
+
+	r, w := io.Pipe()
+	cmd.Stdout = w
+	e.ptyPipe = w
+	return r, nil
+}
+
+// newScanner returns a scanner reading lines from r,
+// limited to the size set using WithScanBufferSize.
+func (e *Environment) newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	if e.scanBufferSize > 0 {
+		scanner.Buffer(make([]byte, 0, min(e.scanBufferSize, 4096)), e.scanBufferSize)
+	}
+	return scanner
+}
+
+// start builds the command, lets setup adjust it
+// and starts it.
+func (e *Environment) start(ctx context.Context, src source, args []any, setup func(cmd *exec.Cmd) error) (*Process, error) {
+	defer e.cleanup()
+
+	var startDeadline time.Time
+	if e.startTimeout > 0 {
+		startDeadline = time.Now().Add(e.startTimeout)
+	}
+
+	ctx, cancel := e.context(ctx)
+
+	p := &Process{
+		ctx:          ctx,
+		cancel:       cancel,
+		processGroup: e.processGroup,
+		logger:       e.logger,
+		onTiming:     e.onTiming,
+		onExit:       e.onExit,
+		successCodes: e.successCodes,
+	}
+
+	// fail reports err for a script that could not be started.
+	fail := func(err error) (*Process, error) {
+		cancel()
+		p.finished(err)
+		return nil, err
+	}
+
+	cmd, err := e.command(ctx, src, args...)
+	if err != nil {
+		return fail(err)
+	}
+	p.cmd = cmd
+	p.writers = e.writers
+	p.stopGrace = e.stopGrace
+	if len(e.forwardSignals) > 0 {
+		p.forwardGroup = e.processGroup || setSignalGroup(cmd)
+	}
+
+	if setup != nil {
+		if err := setup(cmd); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Collect stderr so it can be reported by ExitError
+	// when the caller is not interested in it.
+	if e.tailSize > 0 {
+		p.tail = &tailBuffer{size: e.tailSize}
+	}
+
+	switch {
+	case e.pty:
+		// The terminal merges the streams, so the tail is only added to stdout.
+		if p.tail != nil {
+			cmd.Stdout = teeWriter(cmd.Stdout, p.tail)
+		}
+		t, err := attachPTY(cmd)
+		if err != nil {
+			return fail(err)
+		}
+		p.terminal = t
+		if w := e.ptyPipe; w != nil {
+			go func() {
+				<-t.done
+				w.Close()
+			}()
+		}
+	case cmd.Stderr == nil:
+		p.stderr = &stderrBuffer{size: maxStderrSize}
+		cmd.Stderr = p.stderr
+	case e.captureStderr:
+		p.stderr = &stderrBuffer{size: maxStderrSize}
+		// Only stderr is collected, so a writer shared with stdout
+		// is locked, as exec writes to it from two goroutines.
+		if sameWriter(cmd.Stdout, cmd.Stderr) {
+			lw := &lockedWriter{w: cmd.Stderr}
+			cmd.Stdout, cmd.Stderr = lw, lw
+		}
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, p.stderr)
+	}
+	p.stderrInError = e.captureStderr
+
+	if p.tail != nil && !e.pty {
+		stdout := teeWriter(cmd.Stdout, p.tail)
+		stderr := stdout
+		// Keep stdout and stderr sharing a writer, so exec
+		// does not write to it from two goroutines.
+		if !sameWriter(cmd.Stdout, cmd.Stderr) {
+			stderr = teeWriter(cmd.Stderr, p.tail)
+		}
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+	}
+
+	if e.cgroupLimits != nil {
+		cg, err := attachCgroup(cmd, e.cgroupLimits)
+		if err != nil {
+			if p.terminal != nil {
+				p.terminal.close()
+			}
+			return fail(err)
+		}
+		p.cgroup = cg
+	}
+
+	if e.beforeRun != nil {
+		e.beforeRun(cmd)
+	}
+
+	if e.logger != nil {
+		e.logger.InfoContext(
+			ctx,
+			"command started",
+			slog.String("shell", e.shell.Name()),
+			slog.String("script", src.script),
+			slog.Any("args", logArgs(args, e.logArgValues)),
+		)
+	}
+
+	p.started = time.Now()
+	err = p.startCommand(startDeadline)
+	if errors.Is(err, ErrStartTimeout) {
+		return nil, err
+	}
+	if p.terminal != nil {
+		p.terminal.started()
+	}
+	if err != nil {
+		cancel()
+		if p.terminal != nil {
+			p.terminal.close()
+		}
+		if p.cgroup != nil {
+			p.cgroup.remove()
+		}
+		err = wrapError(ctx, err, nil, nil)
+		p.duration = time.Since(p.started)
+		p.finished(err)
+		return nil, err
+	}
+
+	if len(e.forwardSignals) > 0 {
+		p.forwardSignals(e.forwardSignals)
+	}
+
+	return p, nil
+}
+
+// startCmd starts cmd when a start timeout is set.
+// It is replaced in tests to simulate a slow start.
+var startCmd = (*exec.Cmd).Start
+
+// startCommand starts the command, giving up if it does not start
+// before deadline. The zero time means no deadline.
+func (p *Process) startCommand(deadline time.Time) error {
+	if deadline.IsZero() {
+		return p.cmd.Start()
+	}
+
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		p.abandon(nil)
+		return ErrStartTimeout
+	}
+
+	done := make(chan error, 1)
+	start := startCmd
+	go func() {
+		done <- start(p.cmd)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	p.abandon(done)
+	return ErrStartTimeout
+}
+
+// abandon reports the start timeout and releases the resources
+// of the process. If done is not nil, the process is still starting,
+// so it is killed and released once Start returns.
+func (p *Process) abandon(done <-chan error) {
+	p.duration = time.Since(p.started)
+	p.finished(ErrStartTimeout)
+
+	release := func() {
+		p.cancel()
+		if p.terminal != nil {
+			p.terminal.started()
+			p.terminal.close()
+		}
+		if p.cgroup != nil {
+			p.cgroup.remove()
+		}
+	}
+
+	if done == nil {
+		release()
+		return
+	}
+
+	// Start cannot be interrupted. The process is killed explicitly,
+	// as cancelling the context does nothing without WithTimeout.
+	go func() {
+		if err := <-done; err == nil {
+			p.signal(os.Kill)
+			p.cmd.Wait()
+		}
+		release()
+	}()
+}
+
+// Check checks the syntax of the script without executing it.
+//
+// The shell must implement SyntaxChecker. The returned error
+// includes the diagnostics reported by the shell.
+func (e *Environment) Check(ctx context.Context, script string) error {
+	return e.with([]Option{WithCaptureStderrOnError()}).run(ctx, source{script: script, check: true}, nil)
+}
+
+// Which returns the path of the command name as resolved by the shell,
+// using the PATH, the variables and the working directory of the environment.
+//
+// Builtins and functions are reported by their name.
+// If the command is not found, ErrCommandNotFound is returned.
+func (e *Environment) Which(ctx context.Context, name string) (string, error) {
+	out, err := e.Output(ctx, `command -v "$1"`, Positional(name))
+	// A script killed on cancellation or timeout also returns ExitError.
+	cancelled := errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+	var exitErr ExitError
+	if errors.As(err, &exitErr) && !cancelled {
+		return "", fmt.Errorf("%s: %w", name, ErrCommandNotFound)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	path := strings.TrimSpace(string(out))
+	if path == "" {
+		return "", fmt.Errorf("%s: %w", name, ErrCommandNotFound)
+	}
+	return path, nil
+}
+
+// DryRun returns the command that would be executed by Run,
+// without executing it.
+//
+// The returned string contains the environment variables that differ
+// from the current process environment, followed by the shell and its arguments,
+// quoted so that it can be pasted into a POSIX shell.
+// The values of secret args are redacted.
+func (e *Environment) DryRun(ctx context.Context, script string, args ...any) (string, error) {
+	defer e.cleanup()
+
+	cmd, err := e.command(ctx, source{script: script}, args...)
+	if err != nil {
+		return "", err
+	}
+
+	// When only some variables are inherited, the command starts
+	// with a clean environment and lists them explicitly.
+	inherited := make(map[string]bool)
+	if !e.cleanEnv && e.inheritOnly == nil && e.rawEnv == nil {
+		for _, kv := range os.Environ() {
+			inherited[kv] = true
+		}
+	}
+
+	secrets := make(map[string]string)
+	for _, arg := range args {
+		if v, ok := arg.(SecretArg); ok {
+			secrets[v.Key] = v.Value
+		}
+	}
+
+	var b strings.Builder
+	if e.cleanEnv || e.inheritOnly != nil || e.rawEnv != nil {
+		b.WriteString("env -i ")
+	}
+	for _, kv := range cmd.Env {
+		if inherited[kv] {
+			continue
+		}
+		key, value, _ := strings.Cut(kv, "=")
+		if _, ok := secrets[key]; ok {
+			value = redacted
+		}
+		b.WriteString(key + "=" + quote(value) + " ")
+	}
+
+	for i, arg := range cmd.Args {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		// Shells passing variables on the command line include the values.
+		for _, secret := range secrets {
+			if secret != "" {
+				arg = strings.ReplaceAll(arg, secret, redacted)
+			}
+		}
+		b.WriteString(quote(arg))
+	}
+
+	return b.String(), nil
+}
+
+// ResolveShell returns the absolute path of the shell executable,
+// or an error if it cannot be found.
+func (e *Environment) ResolveShell() (string, error) {
+	if e.shell == nil {
+		return "", ErrNoShell
+	}
+
+	path, err := exec.LookPath(e.shell.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve shell %q: %w", e.shell.Name(), err)
+	}
+	return path, nil
+}
+
+// Clone returns a copy of the environment that can be modified,
+// for example by applying options, without affecting e.
+func (e *Environment) Clone() *Environment {
+	env := *e
+	env.env = maps.Clone(e.env)
+	env.envFiles = slices.Clone(e.envFiles)
+	env.traceEnv = slices.Clone(e.traceEnv)
+	env.inheritOnly = slices.Clone(e.inheritOnly)
+	env.rawEnv = slices.Clone(e.rawEnv)
+	env.unsetEnv = slices.Clone(e.unsetEnv)
+	env.pathPrepend = slices.Clone(e.pathPrepend)
+	env.pathAppend = slices.Clone(e.pathAppend)
+	env.shellArgs = slices.Clone(e.shellArgs)
+	env.successCodes = slices.Clone(e.successCodes)
+	env.forwardSignals = slices.Clone(e.forwardSignals)
+	env.argBuffer = nil
+	return &env
+}
+
+// Apply applies opts to the environment.
+func (e *Environment) Apply(opts ...Option) {
+	for _, opt := range opts {
+		opt(e)
+	}
+}
+
+// with returns a clone of the environment with opts applied, so
+// options appending to its slices do not write into e.
+func (e *Environment) with(opts []Option) *Environment {
+	env := e.Clone()
+	env.Apply(opts...)
+	return env
+}
+
+func (e *Environment) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if e.timeout > 0 {
+		return context.WithTimeout(ctx, e.timeout)
+	}
+	return ctx, func() {}
+}
+
+func (e *Environment) cleanup() {
+	e.argBuffer = e.argBuffer[:0]
+	e.writers = nil
+	e.ptyPipe = nil
+	e.stopGrace = nil
+}
+
+// source describes the script passed to the shell.
+type source struct {
+	// script is either the script itself, or a path to it if file is true.
+	script string
+	file   bool
+
+	// stdin is read by the shell as the script, following script.
+	stdin io.Reader
+
+	// check only checks the syntax of the script.
+	check bool
+}
+
+func (e *Environment) command(ctx context.Context, src source, args ...any) (*exec.Cmd, error) {
+	if e.shell == nil {
+		return nil, ErrNoShell
+	}
+
+	envs := newEnvBuilder(e.baseEnv())
+	if p, ok := e.shell.(EnvProvider); ok {
+		for k, v := range p.Env() {
+			envs.set(k, v)
+		}
+	}
+
+	var fileVars []Arg
+	for _, path := range e.envFiles {
+		vars, err := readEnvFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fileVars = append(fileVars, vars...)
+	}
+	for _, v := range fileVars {
+		envs.set(v.Key, v.Value)
+	}
+
+	for _, v := range sortedArgs(e.env) {
+		if err := v.validate(); err != nil {
+			return nil, err
+		}
+		envs.set(v.Key, v.Value)
+	}
+
+	// runVars are computed when the script is run.
+	var runVars []Arg
+	if e.envFunc != nil {
+		env, err := e.envFunc(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("computing environment: %w", err)
+		}
+		runVars = sortedArgs(env)
+	}
+	for _, t := range e.traceEnv {
+		if value := t.extract(ctx); value != "" {
+			runVars = append(runVars, Arg{Key: t.key, Value: value})
+		}
+	}
+	for _, v := range runVars {
+		if err := v.validate(); err != nil {
+			return nil, err
+		}
+		envs.set(v.Key, v.Value)
+	}
+
+	if len(e.pathPrepend) > 0 || len(e.pathAppend) > 0 {
+		path, _ := envs.get("PATH")
+		envs.set("PATH", extendPath(path, e.pathPrepend, e.pathAppend))
+	}
+
+	var positional []string
+	var vars []Arg
+	addArg := func(arg Arg) {
+		if e.expandArgs {
+			arg.Value = os.Expand(arg.Value, func(key string) string {
+				value, _ := envs.get(key)
+				return value
+			})
+		}
+		envs.set(arg.Key, arg.Value)
+		vars = append(vars, arg)
+	}
+	for i := 0; i < len(args); i++ {
+		switch v := args[i].(type) {
+		case Arg:
+			if err := v.validate(); err != nil {
+				return nil, fmt.Errorf("argument %d: %w", i, err)
+			}
+			addArg(v)
+		case SecretArg:
+			if err := Arg(v).validate(); err != nil {
+				return nil, fmt.Errorf("argument %d: %w", i, err)
+			}
+			addArg(Arg(v))
+		case Positional:
+			positional = append(positional, string(v))
+		case map[string]string:
+			for _, arg := range sortedArgs(v) {
+				if err := arg.validate(); err != nil {
+					return nil, fmt.Errorf("argument %d: %w", i, err)
+				}
+				addArg(arg)
+			}
+		default:
+			if i == len(args)-1 {
+				return nil, fmt.Errorf("invalid number of arguments")
+			}
+			// Neither the key nor the value is included in the errors,
+			// since a value passed in place of a key may be a secret.
+			key := fmt.Sprintf("%v", args[i])
+			if !isValidName(key) {
+				return nil, fmt.Errorf("invalid environment variable name at argument %d", i)
+			}
+			arg := Arg{Key: key, Value: fmt.Sprintf("%v", args[i+1])}
+			if err := arg.validate(); err != nil {
+				return nil, fmt.Errorf("argument %d: %w", i, err)
+			}
+			addArg(arg)
+			i++
+		}
+	}
+
+	for _, key := range e.unsetEnv {
+		envs.unset(key)
+	}
+
+	e.argBuffer = append(e.argBuffer, e.shellArgs...)
+	if src.check {
+		sc, ok := e.shell.(SyntaxChecker)
+		if !ok {
+			return nil, fmt.Errorf("syntax check with %s: %w", e.shell.Name(), errors.ErrUnsupported)
+		}
+		e.argBuffer = append(e.argBuffer, sc.SyntaxCheckArgs()...)
+	}
+
+	script := src.script
+	if e.strictMode && !src.file {
+		script = strictModePrefix(e.shell) + script
+	}
+	if e.umask != "" && !src.file {
+		script = "umask " + e.umask + "; " + script
+	}
+
+	switch f, ok := e.shell.(ArgsFormatter); {
+	case src.stdin != nil:
+		ss, ok := e.shell.(StdinScripter)
+		if !ok {
+			return nil, fmt.Errorf("reading the script from stdin with %s: %w", e.shell.Name(), errors.ErrUnsupported)
+		}
+		e.argBuffer = append(e.argBuffer, ss.StdinScriptArgs()...)
+		e.argBuffer = append(e.argBuffer, positional...)
+	case ok:
+		if src.file {
+			return nil, fmt.Errorf("running a file with %s: %w", e.shell.Name(), errors.ErrUnsupported)
+		}
+		if _, err := positionalArgs(innermostShell(e.shell), positional); err != nil {
+			return nil, err
+		}
+		env := append(append(append(fileVars, sortedArgs(e.env)...), runVars...), vars...)
+		env = slices.DeleteFunc(env, func(arg Arg) bool {
+			return slices.ContainsFunc(e.unsetEnv, func(key string) bool {
+				return envKey(key) == envKey(arg.Key)
+			})
+		})
+		// The formatter may embed the variables into a command line
+		// run by another shell, so only plain names are allowed.
+		for i, arg := range env {
+			if !isValidName(arg.Key) {
+				return nil, fmt.Errorf("%s: invalid environment variable name at position %d", e.shell.Name(), i)
+			}
+		}
+		e.argBuffer = append(e.argBuffer, f.FormatArgs(Invocation{
+			Script:     script,
+			Env:        env,
+			Positional: positional,
+		})...)
+	case src.file:
+		prefix := e.shell.Prefix()
+		if n := len(prefix); n > 0 && prefix[n-1] == "-c" {
+			prefix = prefix[:n-1]
+		}
+		e.argBuffer = append(e.argBuffer, prefix...)
+		e.argBuffer = append(e.argBuffer, script)
+		e.argBuffer = append(e.argBuffer, positional...)
+	default:
+		e.argBuffer = append(e.argBuffer, e.shell.Prefix()...)
+		e.argBuffer = append(e.argBuffer, script)
+		e.argBuffer = append(e.argBuffer, e.shell.Suffix()...)
+		args, err := positionalArgs(e.shell, positional)
+		if err != nil {
+			return nil, err
+		}
+		e.argBuffer = append(e.argBuffer, args...)
+	}
+
+	cmd := exec.CommandContext(ctx, e.shell.Name(), e.argBuffer...)
+	// Without stdin, exec connects the script to the null device,
+	// so it never reads the input of the current process.
+	cmd.Stdin = e.stdin
+	if src.stdin != nil {
+		cmd.Stdin = io.MultiReader(strings.NewReader(script), src.stdin)
+	}
+	stdout := e.checkWriter(e.stdout)
+	stderr := stdout
+	if !sameWriter(e.stdout, e.stderr) {
+		stderr = e.checkWriter(e.stderr)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if e.combined != nil {
+		w := &lockedWriter{w: e.checkWriter(e.combined)}
+		cmd.Stdout = teeWriter(stdout, w)
+		cmd.Stderr = teeWriter(stderr, w)
+	}
+	if e.stdinFile != nil && src.stdin == nil {
+		cmd.Stdin = e.stdinFile
+	}
+	if e.stdoutFile != nil {
+		cmd.Stdout = e.stdoutFile
+	}
+	if e.stderrFile != nil {
+		cmd.Stderr = e.stderrFile
+	}
+	cmd.Env = envs.list()
+
+	if e.sysProcAttr != nil {
+		attr := *e.sysProcAttr
+		cmd.SysProcAttr = &attr
+	}
+
+	if e.processGroup {
+		if err := setProcessGroup(cmd); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.credential != nil {
+		setCredential(cmd, e.credential)
+	}
+
+	if e.cancelGrace > 0 {
+		e.stopGrace = setCancelGrace(cmd, e.cancelGrace, e.processGroup)
+	}
+
+	if e.workingDir != "" {
+		if err := validateDir(e.workingDir); err != nil {
+			return nil, err
+		}
+		cmd.Dir = e.workingDir
+	}
+
+	return cmd, nil
+}
+
+// baseEnv returns the variables inherited from the current process.
+func (e *Environment) baseEnv() []string {
+	switch {
+	case e.rawEnv != nil:
+		return e.rawEnv
+	case e.cleanEnv:
+		return nil
+	case e.inheritOnly != nil:
+		var base []string
+		for _, key := range e.inheritOnly {
+			if value, ok := os.LookupEnv(key); ok {
+				base = append(base, key+"="+value)
+			}
+		}
+		return base
+	default:
+		return os.Environ()
+	}
+}
+
+// checkWriter wraps w to record its write errors, reported by Process.Wait.
+// Files are left as is, since the script writes to them directly.
+func (e *Environment) checkWriter(w io.Writer) io.Writer {
+	switch w.(type) {
+	case nil, *os.File:
+		return w
+	}
+	if w == io.Discard {
+		return w
+	}
+
+	cw := &checkedWriter{w: w}
+	e.writers = append(e.writers, cw)
+	return cw
+}
+
+func validateDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("invalid working directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid working directory %q: not a directory", dir)
+	}
+	return nil
+}
+
+// extendPath returns path with the before and after
+// directories added to its beginning and end.
+func extendPath(path string, before, after []string) string {
+	dirs := slices.Clone(before)
+	if path != "" {
+		dirs = append(dirs, path)
+	}
+	dirs = append(dirs, after...)
+	return strings.Join(dirs, string(filepath.ListSeparator))
+}
+
+// strictModePrefix returns the commands that enable strict mode
+// in shell, based on the features it reports.
+func strictModePrefix(shell Shell) string {
+	fr, ok := shell.(FeatureReporter)
+	if !ok {
+		return ""
+	}
+	if fr.Supports(FeaturePipefail) {
+		return "set -euo pipefail; "
+	}
+	return "set -eu; "
+}
+
+// innerArgs returns the arguments invoking shell with the script,
+// for shells that wrap another shell.
+func innerArgs(shell Shell, inv Invocation) []string {
+	args := []string{shell.Name()}
+	args = append(args, shell.Prefix()...)
+	args = append(args, inv.Script)
+	args = append(args, shell.Suffix()...)
+	// The positional args are checked before FormatArgs is called.
+	positional, _ := positionalArgs(shell, inv.Positional)
+	return append(args, positional...)
+}
+
+// positionalArgs returns the arguments passing positional
+// to an inline script run by shell.
+func positionalArgs(shell Shell, positional []string) ([]string, error) {
+	if len(positional) == 0 {
+		return nil, nil
+	}
+	if pf, ok := shell.(PositionalFormatter); ok {
+		return pf.PositionalArgs(positional)
+	}
+	// The first argument after an inline script is $0.
+	return append([]string{shell.Name()}, positional...), nil
+}
+
+// wrapper is implemented by shells running the script using another shell.
+type wrapper interface {
+	wrapped() Shell
+}
+
+// innermostShell returns the shell that runs the script,
+// unwrapping the shells that run it using another one.
+func innermostShell(shell Shell) Shell {
+	for {
+		w, ok := shell.(wrapper)
+		if !ok {
+			return shell
+		}
+		shell = w.wrapped()
+	}
+}
+
+// mapArgs returns env as extra args.
+func mapArgs(env map[string]string) []any {
+	args := make([]any, 0, len(env))
+	for k, v := range env {
+		args = append(args, Arg{Key: k, Value: v})
+	}
+	return args
+}
+
+// sortedArgs returns env as a list of Arg sorted by key.
+func sortedArgs(env map[string]string) []Arg {
+	args := make([]Arg, 0, len(env))
+	for k, v := range env {
+		args = append(args, Arg{Key: k, Value: v})
+	}
+	slices.SortFunc(args, func(a, b Arg) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return args
+}
+
+// caseInsensitiveEnv reports whether variable names are case-insensitive,
+// so that "Path" and "PATH" are the same variable, as on Windows.
+var caseInsensitiveEnv = runtime.GOOS == "windows"
+
+// envKey returns the key variables are indexed by in envBuilder.
+func envKey(key string) string {
+	if caseInsensitiveEnv {
+		return strings.ToUpper(key)
+	}
+	return key
+}
+
+// envBuilder builds a list of KEY=VALUE pairs where
+// each key appears at most once and later values override earlier ones.
+type envBuilder struct {
+	vars  []string
+	index map[string]int
+}
+
+func newEnvBuilder(base []string) *envBuilder {
+	b := &envBuilder{
+		vars:  make([]string, 0, len(base)),
+		index: make(map[string]int, len(base)),
+	}
+
+	for _, kv := range base {
+		if kv == "" {
+			continue
+		}
+
+		// Windows has variables such as "=C:=C:\", so the
+		// separator is searched for after the first character.
+		i := strings.IndexByte(kv[1:], '=') + 1
+		if i == 0 {
+			continue
+		}
+		b.set(kv[:i], kv[i+1:])
+	}
+
+	return b
+}
+
+func (b *envBuilder) set(key, value string) {
+	if i, ok := b.index[envKey(key)]; ok {
+		b.vars[i] = key + "=" + value
+		return
+	}
+
+	b.index[envKey(key)] = len(b.vars)
+	b.vars = append(b.vars, key+"="+value)
+}
+
+func (b *envBuilder) unset(key string) {
+	i, ok := b.index[envKey(key)]
+	if !ok {
+		return
+	}
+
+	b.vars = slices.Delete(b.vars, i, i+1)
+	delete(b.index, envKey(key))
+	for k, j := range b.index {
+		if j > i {
+			b.index[k] = j - 1
+		}
+	}
+}
+
+func (b *envBuilder) get(key string) (string, bool) {
+	i, ok := b.index[envKey(key)]
+	if !ok {
+		return "", false
+	}
+	// The stored key may differ in case on Windows.
+	kv := b.vars[i]
+	return kv[strings.IndexByte(kv[1:], '=')+2:], true
+}
+
+func (b *envBuilder) list() []string {
+	return b.vars
+}
+
+// Quote returns s enclosed in single quotes, so it can be safely
+// embedded into a script for a POSIX shell as a single word.
+//
+// For example, fmt.Sprintf("echo %s", sh.Quote(input)) prints input
+// as is, whatever characters it contains.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Dedent removes the leading whitespace common to all non-blank lines
+// of script, so scripts can be indented along with the Go code.
+//
+// Relative indentation is preserved, and whitespace-only lines are emptied.
+func Dedent(script string) string {
+	lines := strings.Split(script, "\n")
+
+	var margin string
+	found := false
+	for _, line := range lines {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+
+		indent := line[:len(line)-len(trimmed)]
+		if !found {
+			margin, found = indent, true
+			continue
+		}
+		for !strings.HasPrefix(indent, margin) {
+			margin = margin[:len(margin)-1]
+		}
+	}
+
+	for i, line := range lines {
+		if strings.TrimLeft(line, " \t") == "" {
+			lines[i] = ""
+			continue
+		}
+		lines[i] = line[len(margin):]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// quote returns s quoted for a POSIX shell,
+// leaving it as is if it contains no special characters.
+func quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+
+	for _, c := range s {
+		if !isSafeRune(c) {
+			return Quote(s)
+		}
+	}
+
+	return s
+}
+
+func isSafeRune(c rune) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("_-+=.,:/@%", c)
+}
+
+// isValidName reports whether name is a valid shell identifier,
+// i.e. it matches [A-Za-z_][A-Za-z0-9_]*.
+func isValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, c := range name {
+		switch {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Process is a handle to a script started using Environment.Start.
+type Process struct {
+	cmd    *exec.Cmd
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stderr        *stderrBuffer
+	stderrInError bool
+
+	processGroup bool
+	forwardGroup bool
+	stopSignals  func()
+	stopGrace    func()
+	terminal     *terminal
+	cgroup       *cgroup
+	writers      []*checkedWriter
+	successCodes []int
+	tail         *tailBuffer
+
+	logger   *slog.Logger
+	started  time.Time
+	duration time.Duration
+	onTiming func(d time.Duration)
+	onExit   func(code int, err error)
+}
+
+// Wait waits for the script to exit.
+//
+// The returned error follows the same rules as Environment.Run.
+func (p *Process) Wait() error {
+	defer p.cleanup()
+
+	err := p.cmd.Wait()
+	if p.terminal != nil {
+		p.terminal.wait()
+	}
+	p.duration = time.Since(p.started)
+	if p.onTiming != nil {
+		p.onTiming(p.duration)
+	}
+
+	var stderr []byte
+	if p.stderr != nil {
+		stderr = p.stderr.Bytes()
+	}
+
+	err = wrapError(p.ctx, err, stderr, p.Tail())
+	var exitErr ExitError
+	if errors.As(err, &exitErr) && p.ctx.Err() == nil && slices.Contains(p.successCodes, exitErr.ExitCode()) {
+		err = nil
+	}
+	for _, w := range p.writers {
+		// A failed writer usually makes the script fail as well,
+		// so the writer error is reported instead.
+		if w.err != nil {
+			err = fmt.Errorf("%w: %w", ErrWriterFailed, w.err)
+			break
+		}
+	}
+	if p.stderrInError {
+		if errors.As(err, &exitErr) && len(stderr) > 0 {
+			err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr))
+		}
+	}
+
+	p.finished(err)
+	return err
+}
+
+// Tail returns the last bytes of the output of the script,
+// if they are retained using WithTailBuffer.
+func (p *Process) Tail() []byte {
+	if p.tail == nil {
+		return nil
+	}
+	return p.tail.bytes()
+}
+
+// finished reports the outcome of the script
+// to the logger and the exit callback.
+func (p *Process) finished(err error) {
+	// The command is nil if it could not be built.
+	code := -1
+	if p.cmd != nil {
+		code = p.cmd.ProcessState.ExitCode()
+	}
+
+	if p.onExit != nil {
+		p.onExit(code, err)
+	}
+
+	if p.logger == nil {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.Duration("duration", p.duration),
+		slog.Int("exit_code", code),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+
+	p.logger.LogAttrs(p.ctx, slog.LevelInfo, "command finished", attrs...)
+}
+
+// forwardSignals relays sigs received by the current process
+// to the script until the process is cleaned up.
+func (p *Process) forwardSignals(sigs []os.Signal) {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+
+	go func() {
+		for {
+			select {
+			case sig := <-ch:
+				if p.forwardGroup {
+					signalProcessGroup(p.cmd.Process.Pid, sig)
+				} else {
+					p.cmd.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	p.stopSignals = func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+func (p *Process) cleanup() {
+	if p.stopSignals != nil {
+		p.stopSignals()
+	}
+	if p.stopGrace != nil {
+		p.stopGrace()
+	}
+	if p.cgroup != nil {
+		p.cgroup.remove()
+	}
+	p.cancel()
+}
+
+// Signal sends a signal to the process running the script.
+func (p *Process) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+// Terminate sends SIGTERM to the process running the script,
+// or to its process group if WithProcessGroup is used.
+func (p *Process) Terminate() error {
+	return p.signal(syscall.SIGTERM)
+}
+
+// Kill kills the process running the script,
+// or its process group if WithProcessGroup is used.
+func (p *Process) Kill() error {
+	return p.signal(os.Kill)
+}
+
+func (p *Process) signal(sig os.Signal) error {
+	if p.processGroup {
+		return signalProcessGroup(p.cmd.Process.Pid, sig)
+	}
+	return p.cmd.Process.Signal(sig)
+}
+
+// PID returns the process id of the process running the script.
+func (p *Process) PID() int {
+	return p.cmd.Process.Pid
+}
+
+// ExitError is returned when the script exits with a non-zero exit code.
+//
+// It wraps the underlying *exec.ExitError.
+type ExitError struct {
+	err    *exec.ExitError
+	stderr []byte
+	tail   []byte
+}
+
+func (e ExitError) Error() string {
+	return e.err.Error()
+}
+
+func (e ExitError) Unwrap() error {
+	return e.err
+}
+
+// ExitCode returns the exit code of the script,
+// or -1 if the script was terminated by a signal.
+func (e ExitError) ExitCode() int {
+	return e.err.ExitCode()
+}
+
+// Stderr returns the standard error output of the script,
+// if it was collected. Only the first and the last 32KB are kept.
+func (e ExitError) Stderr() []byte {
+	return e.stderr
+}
+
+// Tail returns the last bytes of the output of the script,
+// if they were retained using WithTailBuffer.
+func (e ExitError) Tail() []byte {
+	return e.tail
+}
+
+// ErrNoShell is returned when the environment has no shell set.
+var ErrNoShell = errors.New("no shell set in the environment")
+
+// ErrCommandNotFound is returned by Environment.Which
+// when the command is not found.
+var ErrCommandNotFound = errors.New("command not found")
+
+// ErrWriterFailed is returned when a writer set using WithStdout,
+// WithStderr or WithCombinedWriter fails. It wraps the error of the writer.
+var ErrWriterFailed = errors.New("writing output failed")
+
+// ErrStartTimeout is returned when the script does not start
+// within the timeout set using WithStartTimeout.
+var ErrStartTimeout = errors.New("script did not start in time")
+
+// ErrOutputTooLarge is returned when the output of the script
+// exceeds the limit set using WithOutputLimit.
+var ErrOutputTooLarge = errors.New("output too large")
+
+// outputBufferPool holds the buffers used by outputBuffer
+// when no pool is set using WithBufferPool.
+var outputBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// maxPooledBufferSize is the capacity above which buffers
+// are not returned to the pool, so a single large output
+// does not keep its memory alive.
+const maxPooledBufferSize = 1 << 20
+
+// outputBuffer collects the output of the script up to limit bytes.
+// Once the limit is exceeded, it calls kill to stop the script.
+type outputBuffer struct {
+	buf      *bytes.Buffer
+	pool     *sync.Pool
+	limit    int64
+	exceeded bool
+	kill     func()
+}
+
+func (e *Environment) outputBuffer(kill func()) *outputBuffer {
+	pool := e.bufferPool
+	if pool == nil {
+		pool = &outputBufferPool
+	}
+	return newOutputBuffer(pool, e.outputLimit, kill)
+}
+
+// newOutputBuffer returns an outputBuffer taking its buffer from pool,
+// or allocating it if pool is nil.
+func newOutputBuffer(pool *sync.Pool, limit int64, kill func()) *outputBuffer {
+	b := &outputBuffer{
+		pool:  pool,
+		limit: limit,
+		kill:  kill,
+	}
+
+	if pool != nil {
+		if buf, ok := pool.Get().(*bytes.Buffer); ok {
+			buf.Reset()
+			b.buf = buf
+		}
+	}
+	if b.buf == nil {
+		b.buf = new(bytes.Buffer)
+	}
+
+	return b
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	if b.limit <= 0 {
+		return b.buf.Write(p)
+	}
+
+	if remaining := b.limit - int64(b.buf.Len()); int64(len(p)) > remaining {
+		n, _ := b.buf.Write(p[:remaining])
+		if !b.exceeded {
+			b.exceeded = true
+			b.kill()
+		}
+		return n, ErrOutputTooLarge
+	}
+
+	return b.buf.Write(p)
+}
+
+// result returns the collected output and err, replacing err
+// with ErrOutputTooLarge if the script was killed because of the limit.
+//
+// The buffer is returned to the pool, so it must not be used afterwards.
+func (b *outputBuffer) result(err error) ([]byte, error) {
+	out := b.bytes()
+	if b.exceeded {
+		return out, fmt.Errorf("%w: limit is %d bytes", ErrOutputTooLarge, b.limit)
+	}
+	return out, err
+}
+
+// bytes returns the collected output, copied out of the buffer
+// if it is returned to the pool.
+func (b *outputBuffer) bytes() []byte {
+	if b.pool == nil {
+		return b.buf.Bytes()
+	}
+
+	var out []byte
+	if b.buf.Len() > 0 {
+		out = bytes.Clone(b.buf.Bytes())
+	}
+	if b.buf.Cap() <= maxPooledBufferSize {
+		b.pool.Put(b.buf)
+	}
+	b.buf = nil
+	return out
+}
+
+// redacted replaces values that should not be logged.
+const redacted = "***"
+
+// logArgs returns the extra args in a form suitable for logging.
+// Values are redacted unless showValues is set.
+func logArgs(args []any, showValues bool) []string {
+	value := func(v any) string {
+		if !showValues {
+			return redacted
+		}
+		return fmt.Sprintf("%v", v)
+	}
+
+	var out []string
+	for i := 0; i < len(args); i++ {
+		switch v := args[i].(type) {
+		case Arg:
+			out = append(out, v.Key+"="+value(v.Value))
+		case SecretArg:
+			out = append(out, v.Key+"="+redacted)
+		case Positional:
+			out = append(out, value(string(v)))
+		case map[string]string:
+			for _, arg := range sortedArgs(v) {
+				out = append(out, arg.Key+"="+value(arg.Value))
+			}
+		default:
+			if i == len(args)-1 {
+				break
+			}
+			out = append(out, fmt.Sprintf("%v=%s", v, value(args[i+1])))
+			i++
+		}
+	}
+
+	return out
+}
+
+// checkedWriter records the first error returned by w.
+type checkedWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (cw *checkedWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// maxStderrSize is the number of bytes kept from both the start
+// and the end of the standard error collected for ExitError.
+const maxStderrSize = 32 << 10
+
+// stderrBuffer retains the first and the last size bytes written to it,
+// like the buffer exec.Cmd.Output uses for the standard error.
+type stderrBuffer struct {
+	size    int
+	prefix  []byte
+	suffix  []byte
+	skipped int64
+}
+
+func (b *stderrBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if len(b.prefix) < b.size {
+		k := min(len(p), b.size-len(b.prefix))
+		b.prefix = append(b.prefix, p[:k]...)
+		p = p[k:]
+	}
+
+	if len(p) >= b.size {
+		b.skipped += int64(len(b.suffix) + len(p) - b.size)
+		b.suffix = append(b.suffix[:0], p[len(p)-b.size:]...)
+		return n, nil
+	}
+
+	if over := len(b.suffix) + len(p) - b.size; over > 0 {
+		b.skipped += int64(over)
+		b.suffix = append(b.suffix[:0], b.suffix[over:]...)
+	}
+	b.suffix = append(b.suffix, p...)
+
+	return n, nil
+}
+
+// Bytes returns the retained output, marking where bytes were dropped.
+func (b *stderrBuffer) Bytes() []byte {
+	if b.skipped == 0 {
+		return append(b.prefix[:len(b.prefix):len(b.prefix)], b.suffix...)
+	}
+
+	out := append([]byte{}, b.prefix...)
+	out = fmt.Appendf(out, "\n... omitting %d bytes ...\n", b.skipped)
+	return append(out, b.suffix...)
+}
+
+// tailBuffer retains the last size bytes written to it.
+type tailBuffer struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(p) >= t.size {
+		t.buf = append(t.buf[:0], p[len(p)-t.size:]...)
+		return len(p), nil
+	}
+
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.size {
+		t.buf = t.buf[len(t.buf)-t.size:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return bytes.Clone(t.buf)
+}
+
+// lockedWriter serializes writes to w.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+// teeWriter returns a writer writing to both w and tee,
+// or just tee if w is nil.
+func teeWriter(w, tee io.Writer) io.Writer {
+	if w == nil {
+		return tee
+	}
+	return io.MultiWriter(w, tee)
+}
+
+// sameWriter reports whether a and b are the same writer.
+func sameWriter(a, b io.Writer) (equal bool) {
+	// Comparing interfaces holding uncomparable types panics.
+	defer func() {
+		if recover() != nil {
+			equal = false
+		}
+	}()
+	return a == b
+}
+
+// wrapError wraps err returned by the command so that it reports
+// both the exit status and the context error that caused the kill, if any.
+func wrapError(ctx context.Context, err error, stderr, tail []byte) error {
+	if err == nil {
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = ExitError{
+			err:    exitErr,
+			stderr: stderr,
+			tail:   tail,
+		}
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %w", ctxErr, err)
+	}
+
+	return err
+}
+
+type Arg struct {
+	Key   string
+	Value string
+}
+
+// SecretArg is an Arg whose value is redacted in logs
+// and in the command returned by DryRun.
+// The script receives the value as usual.
+type SecretArg Arg
+
+// NewArg returns an Arg with value formatted as a string.
+//
+// Numbers are formatted using strconv, booleans as "true" or "false",
+// and other values using fmt's %v verb.
+func NewArg(key string, value any) Arg {
+	return Arg{Key: key, Value: formatValue(value)}
+}
+
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int8:
+		return strconv.FormatInt(int64(v), 10)
+	case int16:
+		return strconv.FormatInt(int64(v), 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func (kv Arg) String() string {
+	return kv.Key + "=" + kv.Value
+}
+
+// validate reports an error if the Arg cannot be represented
+// as an environment variable.
+//
+// An invalid key is not included in the error, since it may
+// be a secret value passed in place of the key.
+func (kv Arg) validate() error {
+	if kv.Key == "" {
+		return errors.New("invalid environment variable name: empty key")
+	}
+
+	for _, c := range kv.Key {
+		if c == '=' || unicode.IsControl(c) {
+			return errors.New("invalid environment variable name: contains '=' or a control character")
+		}
+	}
+
+	if strings.IndexByte(kv.Value, 0) >= 0 {
+		return errors.New("invalid environment variable value: contains NUL")
+	}
+
+	return nil
+}
+
+// Positional is an extra argument that is passed to the script
+// as a positional parameter ($1, $2, ...) instead of an environment variable.
+//
+// Positional parameters are appended after the script in the order they
+// are passed. $0 is set to the name of the shell. Fish receives them
+// as $argv, and PowerShell and Cmd do not support them.
+type Positional string
+
+func Bash() Shell {
+	return &bash{}
+}
+
+// BashAt returns a bash Shell that uses the executable at path
+// instead of resolving bash from PATH.
+func BashAt(path string) Shell {
+	return &bash{path: path}
+}
+
+func Sh() Shell {
+	return &sh{}
+}
+
+func Zsh() Shell {
+	return &zsh{}
+}
+
+// Dash returns a Shell that runs scripts using dash.
+//
+// Unlike Sh, which uses whatever /bin/sh points to, Dash always
+// uses dash, which is useful to ensure a script is free of bashisms.
+func Dash() Shell {
+	return &dash{}
+}
+
+// Ksh returns a Shell that runs scripts using ksh.
+func Ksh() Shell {
+	return &ksh{}
+}
+
+// Ash returns a Shell that runs scripts using busybox ash,
+// the default shell of Alpine based containers.
+func Ash() Shell {
+	return &ash{}
+}
+
+// PowerShell returns a Shell that runs scripts using powershell.
+//
+// Arguments are still exposed to the script as process environment
+// variables, so they are accessible using $env:NAME rather than $NAME.
+func PowerShell() Shell {
+	return &powerShell{}
+}
+
+// Fish returns a Shell that runs scripts using fish.
+//
+// Arguments are passed as exported environment variables, so they are
+// accessible using $NAME. Note that the rest of fish syntax is not POSIX compatible.
+func Fish() Shell {
+	return &fish{}
+}
+
+// Cmd returns a Shell that runs scripts using cmd.exe on Windows.
+//
+// Arguments are passed as environment variables, so they are
+// accessible using %NAME% rather than $NAME.
+func Cmd() Shell {
+	return &cmdShell{}
+}
+
+// shells maps the names accepted by ShellByName
+// to the constructors of the shells.
+var (
+	shellsMu sync.RWMutex
+	shells   = map[string]func() Shell{
+		"bash":       Bash,
+		"sh":         Sh,
+		"zsh":        Zsh,
+		"dash":       Dash,
+		"ksh":        Ksh,
+		"ash":        Ash,
+		"fish":       Fish,
+		"powershell": PowerShell,
+		"cmd":        Cmd,
+	}
+)
+
+// RegisterShell makes the shell returned by factory available
+// using ShellByName under name, replacing any shell registered
+// under the same name, including the built-in ones.
+//
+// It is safe to call RegisterShell concurrently with ShellByName.
+func RegisterShell(name string, factory func() Shell) {
+	if factory == nil {
+		panic("sh: RegisterShell factory is nil")
+	}
+
+	shellsMu.Lock()
+	defer shellsMu.Unlock()
+	shells[name] = factory
+}
+
+// ShellByName returns the shell registered under name, which is one
+// of the built-in shells, as reported by Shell.Name, for example
+// "bash" or "zsh", or a shell registered using RegisterShell.
+func ShellByName(name string) (Shell, error) {
+	shellsMu.RLock()
+	newShell, ok := shells[name]
+	shellsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown shell %q", name)
+	}
+	return newShell(), nil
+}
+
+type bash struct {
+	path string
+}
+
+func (b *bash) Name() string {
+	if b.path != "" {
+		return b.path
+	}
+	return "bash"
+}
+
+func (b *bash) Prefix() []string {
+	return []string{"-c"}
+}
+
+func (b *bash) Suffix() []string {
+	return nil
+}
+
+func (b *bash) SyntaxCheckArgs() []string {
+	return []string{"-n"}
+}
+
+func (b *bash) StdinScriptArgs() []string {
+	return []string{"-s"}
+}
+
+func (b *bash) Supports(feature string) bool {
+	switch feature {
+	case FeaturePipefail, FeatureArrays:
+		return true
+	}
+	return false
+}
+
+var defaultEnvironment = NewEnvironment(&bash{})
+
+// DefaultEnvironment returns the environment used by the package level functions.
+func DefaultEnvironment() *Environment {
+	return defaultEnvironment
+}
+
+func SetDefaultEnvironment(env *Environment) {
+	defaultEnvironment = env
+}
+
+func Run(ctx context.Context, script string, args ...any) error {
+	return defaultEnvironment.Run(ctx, script, args...)
+}
+
+func Output(ctx context.Context, script string, args ...any) ([]byte, error) {
+	return defaultEnvironment.Output(ctx, script, args...)
+}
+
+func OutputString(ctx context.Context, script string, args ...any) (string, error) {
+	return defaultEnvironment.OutputString(ctx, script, args...)
+}
+
+func CombinedOutput(ctx context.Context, script string, args ...any) ([]byte, error) {
+	return defaultEnvironment.CombinedOutput(ctx, script, args...)
+}
+
+// RunSimple is like Run, using context.Background().
+func RunSimple(script string, args ...any) error {
+	return Run(context.Background(), script, args...)
+}
+
+// OutputSimple is like Output, using context.Background().
+func OutputSimple(script string, args ...any) ([]byte, error) {
+	return Output(context.Background(), script, args...)
+}
+
+// MustRun is like Run but panics if the script fails.
+func MustRun(ctx context.Context, script string, args ...any) {
+	if err := Run(ctx, script, args...); err != nil {
+		panic(err)
+	}
+}
+
+// MustOutput is like Output but panics if the script fails.
+func MustOutput(ctx context.Context, script string, args ...any) []byte {
+	out, err := Output(ctx, script, args...)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+type sh struct{}
+
+func (s *sh) Name() string {
+	return "sh"
+}
+
+func (s *sh) Prefix() []string {
+	return []string{"-c"}
+}
+
+func (s *sh) Suffix() []string {
+	return nil
+}
+
+func (s *sh) SyntaxCheckArgs() []string {
+	return []string{"-n"}
+}
+
+func (s *sh) StdinScriptArgs() []string {
+	return []string{"-s"}
+}
+
+func (s *sh) Supports(feature string) bool {
+	return false
+}
+
+type zsh struct{}
+
+func (z *zsh) Name() string {
+	return "zsh"
+}
+
+func (z *zsh) Prefix() []string {
+	return []string{"-c"}
+}
+
+func (z *zsh) Suffix() []string {
+	return nil
+}
+
+func (z *zsh) SyntaxCheckArgs() []string {
+	return []string{"-n"}
+}
+
+func (z *zsh) StdinScriptArgs() []string {
+	return []string{"-s"}
+}
+
+func (z *zsh) Supports(feature string) bool {
+	switch feature {
+	case FeaturePipefail, FeatureArrays:
+		return true
+	}
+	return false
+}
+
+type powerShell struct{}
+
+func (p *powerShell) Name() string {
+	return "powershell"
+}
+
+func (p *powerShell) Prefix() []string {
+	return []string{"-NoProfile", "-Command"}
+}
+
+func (p *powerShell) Suffix() []string {
+	return nil
+}
+
+// PositionalArgs reports an error, as the arguments following
+// the script would be appended to the command it runs.
+func (p *powerShell) PositionalArgs(positional []string) ([]string, error) {
+	return nil, fmt.Errorf("positional parameters with powershell: %w", errors.ErrUnsupported)
+}
+
+type fish struct{}
+
+func (f *fish) Name() string {
+	return "fish"
+}
+
+func (f *fish) Prefix() []string {
+	return []string{"-c"}
+}
+
+func (f *fish) Suffix() []string {
+	return nil
+}
+
+// PositionalArgs passes positional as $argv, which has no $0.
+func (f *fish) PositionalArgs(positional []string) ([]string, error) {
+	return positional, nil
+}
+
+type dash struct{}
+
+func (d *dash) Name() string {
+	return "dash"
+}
+
+func (d *dash) Prefix() []string {
+	return []string{"-c"}
+}
+
+func (d *dash) Suffix() []string {
+	return nil
+}
+
+func (d *dash) SyntaxCheckArgs() []string {
+	return []string{"-n"}
+}
+
+func (d *dash) StdinScriptArgs() []string {
+	return []string{"-s"}
+}
+
+func (d *dash) Supports(feature string) bool {
+	return false
+}
+
+type ksh struct{}
+
+func (k *ksh) Name() string {
+	return "ksh"
+}
+
+func (k *ksh) Prefix() []string {
+	return []string{"-c"}
+}
+
+func (k *ksh) Suffix() []string {
+	return nil
+}
+
+func (k *ksh) SyntaxCheckArgs() []string {
+	return []string{"-n"}
+}
+
+func (k *ksh) StdinScriptArgs() []string {
+	return []string{"-s"}
+}
+
+func (k *ksh) Supports(feature string) bool {
+	switch feature {
+	case FeaturePipefail, FeatureArrays:
+		return true
+	}
+	return false
+}
+
+type ash struct{}
+
+func (a *ash) Name() string {
+	return "ash"
+}
+
+func (a *ash) Prefix() []string {
+	return []string{"-c"}
+}
+
+func (a *ash) Suffix() []string {
+	return nil
+}
+
+func (a *ash) SyntaxCheckArgs() []string {
+	return []string{"-n"}
+}
+
+func (a *ash) StdinScriptArgs() []string {
+	return []string{"-s"}
+}
+
+func (a *ash) Supports(feature string) bool {
+	return feature == FeaturePipefail
+}
+
+type cmdShell struct{}
+
+func (c *cmdShell) Name() string {
+	return "cmd"
+}
+
+func (c *cmdShell) Prefix() []string {
+	return []string{"/C"}
+}
+
+func (c *cmdShell) Suffix() []string {
+	return nil
+}
+
+// PositionalArgs reports an error, as the arguments following
+// the script would be appended to the command line it runs.
+func (c *cmdShell) PositionalArgs(positional []string) ([]string, error) {
+	return nil, fmt.Errorf("positional parameters with cmd: %w", errors.ErrUnsupported)
 }
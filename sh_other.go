@@ -0,0 +1,36 @@
+//go:build !unix
+
+package sh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+func setProcessGroup(cmd *exec.Cmd) error {
+	return fmt.Errorf("process groups: %w", errors.ErrUnsupported)
+}
+
+func setSignalGroup(cmd *exec.Cmd) bool {
+	return false
+}
+
+func setCancelGrace(cmd *exec.Cmd, grace time.Duration, processGroup bool) func() {
+	cmd.WaitDelay = grace
+	return func() {}
+}
+
+func signalProcessGroup(pid int, sig os.Signal) error {
+	return fmt.Errorf("process groups: %w", errors.ErrUnsupported)
+}
+
+type credential struct{}
+
+func setCredential(cmd *exec.Cmd, c *credential) {}
+
+func isBrokenPipe(err error) bool {
+	return false
+}
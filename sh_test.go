@@ -1,17 +1,64 @@
 package sh
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/unicode"
 )
 
-func TestCommonShellsRun(t *testing.T) {
-	shells := []Shell{
+func commonShells() []Shell {
+	return []Shell{
+		Bash(),
+		Sh(),
+		Zsh(),
+		Fish(),
+		Dash(),
+		Ksh(),
+		Ash(),
+	}
+}
+
+// posixShells returns shells that support POSIX syntax,
+// such as positional parameters.
+func posixShells() []Shell {
+	return []Shell{
 		Bash(),
 		Sh(),
+		Zsh(),
+		Dash(),
+		Ksh(),
+		Ash(),
+	}
+}
+
+func requireShell(t *testing.T, shell Shell) {
+	t.Helper()
+	if _, err := exec.LookPath(shell.Name()); err != nil {
+		t.Skipf("shell %q is not installed", shell.Name())
 	}
+}
+
+func TestCommonShellsRun(t *testing.T) {
+	shells := commonShells()
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
@@ -54,6 +101,7 @@ func TestCommonShellsRun(t *testing.T) {
 		for _, shell := range shells {
 			testName := fmt.Sprintf("%s_%s", shell.Name(), name)
 			t.Run(testName, func(t *testing.T) {
+				requireShell(t, shell)
 				env := env
 				env.shell = shell
 
@@ -77,10 +125,7 @@ func TestCommonShellsRun(t *testing.T) {
 }
 
 func TestCommonShellsOutputs(t *testing.T) {
-	shells := []Shell{
-		Bash(),
-		Sh(),
-	}
+	shells := commonShells()
 
 	var stderr bytes.Buffer
 	env := Environment{
@@ -121,6 +166,7 @@ func TestCommonShellsOutputs(t *testing.T) {
 		for _, shell := range shells {
 			testName := fmt.Sprintf("%s_%s", shell.Name(), name)
 			t.Run(testName, func(t *testing.T) {
+				requireShell(t, shell)
 				env := env
 				env.shell = shell
 
@@ -144,6 +190,151 @@ func TestCommonShellsOutputs(t *testing.T) {
 	}
 }
 
+func TestOutputString(t *testing.T) {
+	env := NewEnvironment(Bash())
+
+	out, err := env.OutputString(context.Background(), "echo hi")
+	if err != nil {
+		t.Fatalf("OutputString() error = %v", err)
+	}
+	if out != "hi" {
+		t.Errorf("OutputString() = %q, want %q", out, "hi")
+	}
+
+	out, err = OutputString(context.Background(), "printf 'a\nb\n\n'")
+	if err != nil {
+		t.Fatalf("OutputString() error = %v", err)
+	}
+	if out != "a\nb" {
+		t.Errorf("OutputString() = %q, want %q", out, "a\nb")
+	}
+}
+
+func TestResult(t *testing.T) {
+	var stdout bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&stdout))
+
+	result, err := env.Result(context.Background(), "echo out; echo err >&2; exit 3")
+	if err != nil {
+		t.Fatalf("Result() error = %v", err)
+	}
+
+	if result.ExitCode != 3 {
+		t.Errorf("Result().ExitCode = %d, want 3", result.ExitCode)
+	}
+	if string(result.Stdout) != "out\n" {
+		t.Errorf("Result().Stdout = %q, want %q", result.Stdout, "out\n")
+	}
+	if string(result.Stderr) != "err\n" {
+		t.Errorf("Result().Stderr = %q, want %q", result.Stderr, "err\n")
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("Result() wrote to configured stdout: %q", stdout.String())
+	}
+
+	result, err = env.Result(context.Background(), "true")
+	if err != nil || result.ExitCode != 0 {
+		t.Errorf("Result() = %v, %v, want exit code 0", result, err)
+	}
+
+	_, err = NewEnvironment(BashAt("/nonexistent/bash")).Result(context.Background(), "true")
+	if err == nil {
+		t.Errorf("Result() expected error for missing shell, got nil")
+	}
+}
+
+func TestPipe(t *testing.T) {
+	env := NewEnvironment(Bash())
+
+	out, err := env.Pipe(context.Background(), "echo hello", "tr a-z A-Z")
+	if err != nil {
+		t.Fatalf("Pipe() error = %v", err)
+	}
+	if string(out) != "HELLO\n" {
+		t.Errorf("Pipe() = %q, want %q", out, "HELLO\n")
+	}
+
+	out, err = env.Pipe(context.Background(), "printf 'b\na\nb\n'", "sort", "uniq")
+	if err != nil {
+		t.Fatalf("Pipe() error = %v", err)
+	}
+	if string(out) != "a\nb\n" {
+		t.Errorf("Pipe() = %q, want %q", out, "a\nb\n")
+	}
+
+	_, err = env.Pipe(context.Background(), "echo hello", "cat > /dev/null; exit 4", "cat")
+	var exitErr ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 4 {
+		t.Errorf("Pipe() error = %v, want exit code 4", err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "stage 1") {
+		t.Errorf("Pipe() error = %v, want to mention stage 1", err)
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+	env := NewEnvironment(Bash(), WithOutputLimit(1024))
+
+	out, err := env.Output(context.Background(), "yes | head -c 100000")
+	if !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("Output() error = %v, want %v", err, ErrOutputTooLarge)
+	}
+	if len(out) != 1024 {
+		t.Errorf("Output() returned %d bytes, want 1024", len(out))
+	}
+
+	out, err = env.CombinedOutput(context.Background(), "yes >&2")
+	if !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("CombinedOutput() error = %v, want %v", err, ErrOutputTooLarge)
+	}
+	if len(out) != 1024 {
+		t.Errorf("CombinedOutput() returned %d bytes, want 1024", len(out))
+	}
+
+	result, err := NewEnvironment(Bash(), WithOutputLimit(10)).Result(context.Background(), "head -c 100000 /dev/zero")
+	if !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("Result() error = %v, want %v", err, ErrOutputTooLarge)
+	}
+	if result == nil || len(result.Stdout) != 10 {
+		t.Errorf("Result() = %v, want 10 bytes of stdout", result)
+	}
+
+	out, err = env.Output(context.Background(), "head -c 1024 /dev/zero")
+	if err != nil {
+		t.Errorf("Output() error = %v", err)
+	}
+	if len(out) != 1024 {
+		t.Errorf("Output() returned %d bytes, want 1024", len(out))
+	}
+}
+
+func TestOutputStderr(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&stdout), WithStderr(&stderr))
+
+	out, errOut, err := env.OutputStderr(context.Background(), "echo out; echo err >&2")
+	if err != nil {
+		t.Fatalf("OutputStderr() error = %v", err)
+	}
+	if string(out) != "out\n" {
+		t.Errorf("OutputStderr() stdout = %q, want %q", out, "out\n")
+	}
+	if string(errOut) != "err\n" {
+		t.Errorf("OutputStderr() stderr = %q, want %q", errOut, "err\n")
+	}
+	if stdout.Len() != 0 || stderr.Len() != 0 {
+		t.Errorf("OutputStderr() wrote to configured writers: stdout = %q, stderr = %q", stdout.String(), stderr.String())
+	}
+
+	_, errOut, err = env.OutputStderr(context.Background(), "echo failed >&2; exit 1")
+	if err == nil {
+		t.Errorf("OutputStderr() expected error, got nil")
+	}
+	if string(errOut) != "failed\n" {
+		t.Errorf("OutputStderr() stderr = %q, want %q", errOut, "failed\n")
+	}
+}
+
 func TestArgs(t *testing.T) {
 	tt := map[string]struct {
 		args      []any
@@ -169,6 +360,34 @@ func TestArgs(t *testing.T) {
 			args:      []any{"TEST_ARG_1", "test_arg1_value", "TEST_ARG_2"},
 			expectErr: true,
 		},
+		"NonStringKey": {
+			args:      []any{5, "x"},
+			expectErr: true,
+		},
+		"ArgKeyWithEquals": {
+			args:      []any{Arg{"A=B", "x"}},
+			expectErr: true,
+		},
+		"ArgKeyWithNewline": {
+			args:      []any{Arg{"A\nB", "x"}},
+			expectErr: true,
+		},
+		"ArgEmptyKey": {
+			args:      []any{Arg{"", "x"}},
+			expectErr: true,
+		},
+		"ArgValueWithNUL": {
+			args:      []any{Arg{"A", "x\x00y"}},
+			expectErr: true,
+		},
+		"ArgEmptyValue": {
+			args:      []any{Arg{"A", ""}},
+			expectErr: false,
+		},
+		"InvalidKeyName": {
+			args:      []any{"1TEST_ARG", "x"},
+			expectErr: true,
+		},
 	}
 
 	for name, tc := range tt {
@@ -195,60 +414,2358 @@ func TestArgs(t *testing.T) {
 	}
 }
 
+func TestNewArg(t *testing.T) {
+	tt := map[string]struct {
+		arg  Arg
+		want string
+	}{
+		"Int":     {arg: NewArg("COUNT", 42), want: "COUNT=42"},
+		"Bool":    {arg: NewArg("FLAG", true), want: "FLAG=true"},
+		"String":  {arg: NewArg("NAME", "value"), want: "NAME=value"},
+		"Uint8":   {arg: NewArg("BYTE", uint8(255)), want: "BYTE=255"},
+		"Float":   {arg: NewArg("RATIO", 1000000.5), want: "RATIO=1000000.5"},
+		"Bytes":   {arg: NewArg("DATA", []byte("raw")), want: "DATA=raw"},
+		"Default": {arg: NewArg("DURATION", time.Second), want: "DURATION=1s"},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.arg.String(); got != tc.want {
+				t.Errorf("NewArg().String() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	out, err := NewEnvironment(Bash()).Output(context.Background(), "echo $COUNT $FLAG", NewArg("COUNT", 42), NewArg("FLAG", true))
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if string(out) != "42 true\n" {
+		t.Errorf("Output() = %q, want %q", out, "42 true\n")
+	}
+}
+
+func TestRunEnv(t *testing.T) {
+	var stdout bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&stdout))
+
+	args := map[string]string{
+		"TEST_ARG_1": "one",
+		"TEST_ARG_2": "two",
+	}
+
+	if err := env.RunEnv(context.Background(), "echo $TEST_ARG_1 $TEST_ARG_2", args); err != nil {
+		t.Fatalf("RunEnv() error = %v", err)
+	}
+	if stdout.String() != "one two\n" {
+		t.Errorf("RunEnv() stdout = %q, want %q", stdout.String(), "one two\n")
+	}
+
+	out, err := env.OutputEnv(context.Background(), "echo $TEST_ARG_1 $TEST_ARG_2", args)
+	if err != nil {
+		t.Fatalf("OutputEnv() error = %v", err)
+	}
+	if string(out) != "one two\n" {
+		t.Errorf("OutputEnv() = %q, want %q", out, "one two\n")
+	}
+}
+
+func TestInvalidArgName(t *testing.T) {
+	err := Run(context.Background(), "echo", 5, "x")
+	if err == nil {
+		t.Fatalf("Run() expected error, got nil")
+	}
+
+	if !strings.Contains(err.Error(), "invalid environment variable name") {
+		t.Errorf("Run() error = %v, want invalid environment variable name error", err)
+	}
+}
+
+func TestEnvOverridesInherited(t *testing.T) {
+	t.Setenv("TEST_INHERITED", "parent")
+
+	env := NewEnvironment(Bash(), WithEnv(map[string]string{
+		"PATH":           "/usr/bin:/bin",
+		"TEST_INHERITED": "env",
+	}))
+	defer env.cleanup()
+
+	cmd, err := env.command(context.Background(), source{script: "true"}, "TEST_INHERITED", "arg")
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+
+	var paths, inherited []string
+	for _, kv := range cmd.Env {
+		switch {
+		case strings.HasPrefix(kv, "PATH="):
+			paths = append(paths, kv)
+		case strings.HasPrefix(kv, "TEST_INHERITED="):
+			inherited = append(inherited, kv)
+		}
+	}
+
+	if len(paths) != 1 || paths[0] != "PATH=/usr/bin:/bin" {
+		t.Errorf("cmd.Env PATH entries = %v, want [PATH=/usr/bin:/bin]", paths)
+	}
+
+	if len(inherited) != 1 || inherited[0] != "TEST_INHERITED=arg" {
+		t.Errorf("cmd.Env TEST_INHERITED entries = %v, want [TEST_INHERITED=arg]", inherited)
+	}
+}
+
+func TestCleanEnv(t *testing.T) {
+	t.Setenv("HOME", "/test/home")
+
+	env := NewEnvironment(Bash(), WithCleanEnv(), WithEnv(map[string]string{
+		"FOO": "bar",
+	}))
+
+	out, err := env.Output(context.Background(), "env")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	vars := strings.Split(string(out), "\n")
+	if !slices.Contains(vars, "FOO=bar") {
+		t.Errorf("Output() = %q, want FOO=bar", out)
+	}
+
+	for _, kv := range vars {
+		if strings.HasPrefix(kv, "HOME=") {
+			t.Errorf("Output() = %q, want no HOME", out)
+		}
+	}
+}
+
+func TestPositional(t *testing.T) {
+	for _, shell := range posixShells() {
+		t.Run("Positional_"+shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+
+			out, err := NewEnvironment(shell).Output(
+				context.Background(),
+				`echo "$1-$2-$TEST_ARG"`,
+				Positional("a"),
+				Arg{"TEST_ARG", "c"},
+				Positional("b"),
+			)
+			if err != nil {
+				t.Fatalf("Output() error = %v", err)
+			}
+
+			if string(out) != "a-b-c\n" {
+				t.Errorf("Output() = %q, want %q", out, "a-b-c\n")
+			}
+		})
+	}
+
+	t.Run("Positional_fish", func(t *testing.T) {
+		env := NewEnvironment(Fish())
+		defer env.cleanup()
+
+		cmd, err := env.command(context.Background(), source{script: "echo $argv"}, Positional("a"), Positional("b"))
+		if err != nil {
+			t.Fatalf("command() error = %v", err)
+		}
+		if want := []string{"fish", "-c", "echo $argv", "a", "b"}; !slices.Equal(cmd.Args, want) {
+			t.Errorf("command() args = %q, want %q", cmd.Args, want)
+		}
+
+		requireShell(t, Fish())
+		out, err := env.Output(context.Background(), `echo $argv[1]-$argv[2]`, Positional("a"), Positional("b"))
+		if err != nil {
+			t.Fatalf("Output() error = %v", err)
+		}
+		if string(out) != "a-b\n" {
+			t.Errorf("Output() = %q, want %q", out, "a-b\n")
+		}
+	})
+
+	for _, shell := range []Shell{PowerShell(), Cmd(), SSH("example.com", WithSSHRemoteShell(PowerShell()))} {
+		t.Run("Positional_"+shell.Name(), func(t *testing.T) {
+			_, err := NewEnvironment(shell).DryRun(context.Background(), "echo", Positional("a"))
+			if !errors.Is(err, errors.ErrUnsupported) {
+				t.Errorf("DryRun() error = %v, want %v", err, errors.ErrUnsupported)
+			}
+		})
+	}
+}
+
+func TestInvalidArgKey(t *testing.T) {
+	err := Run(context.Background(), "echo", Arg{"A=B", "x"})
+	if err == nil {
+		t.Fatalf("Run() expected error, got nil")
+	}
+
+	if !strings.Contains(err.Error(), "invalid environment variable name") {
+		t.Errorf("Run() error = %v, want invalid environment variable name error", err)
+	}
+}
+
+func TestArgErrorsOmitValues(t *testing.T) {
+	const secret = "s3cr3t-t0ken"
+
+	tt := map[string][]any{
+		"value in place of key": {"TOKEN", secret, secret + " x", "y"},
+		"missing value":         {secret + " x"},
+		"key with equals":       {Arg{Key: "TOKEN=" + secret, Value: "x"}},
+		"secret key":            {SecretArg{Key: "TOKEN=" + secret, Value: "x"}},
+		"map key":               {map[string]string{"TOKEN=" + secret: "x"}},
+		"value with NUL":        {"TOKEN", secret + "\x00"},
+		"key of value with NUL": {Arg{Key: secret, Value: "x\x00"}},
+	}
+
+	for name, args := range tt {
+		t.Run(name, func(t *testing.T) {
+			err := NewEnvironment(Bash()).Run(context.Background(), "true", args...)
+			if err == nil {
+				t.Fatalf("Run() expected error, got nil")
+			}
+			if strings.Contains(err.Error(), secret) {
+				t.Errorf("Run() error = %q, contains the value", err)
+			}
+		})
+	}
+}
+
 func TestExitCase(t *testing.T) {
 	err := Run(context.Background(), "exit 1")
 	if err == nil {
 		t.Fatalf("Run() expected error, got nil")
 	}
 
+	var exitErr ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Run() error = %T, want ExitError", err)
+	}
+	if exitErr.ExitCode() != 1 {
+		t.Errorf("ExitError.ExitCode() = %d, want 1", exitErr.ExitCode())
+	}
+
+	_, err = Output(context.Background(), "echo failed >&2; exit 3")
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Output() error = %T, want ExitError", err)
+	}
+	if exitErr.ExitCode() != 3 {
+		t.Errorf("ExitError.ExitCode() = %d, want 3", exitErr.ExitCode())
+	}
+	if string(exitErr.Stderr()) != "failed\n" {
+		t.Errorf("ExitError.Stderr() = %q, want %q", exitErr.Stderr(), "failed\n")
+	}
+
 	err = Run(context.Background(), "exit 0")
 	if err != nil {
 		t.Fatalf("Run() expected no error, got %v", err)
 	}
 }
 
-func TestWorkigDir(t *testing.T) {
-	shells := []Shell{
+func TestTimeout(t *testing.T) {
+	env := NewEnvironment(Bash(), WithTimeout(100*time.Millisecond))
+
+	start := time.Now()
+	err := env.Run(context.Background(), "sleep 5")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Run() took %v, want the script to be killed on timeout", elapsed)
+	}
+
+	if err := NewEnvironment(Bash(), WithTimeout(0)).Run(context.Background(), "true"); err != nil {
+		t.Errorf("Run() error = %v, want nil", err)
+	}
+}
+
+func TestStartTimeout(t *testing.T) {
+	// The start timeout does not limit the time the script runs.
+	env := NewEnvironment(Bash(), WithStartTimeout(50*time.Millisecond))
+	if err := env.Run(context.Background(), "sleep 0.2"); err != nil {
+		t.Errorf("Run() error = %v, want nil", err)
+	}
+
+	dir := t.TempDir()
+	env = NewEnvironment(
 		Bash(),
-		Sh(),
+		WithStartTimeout(10*time.Millisecond),
+		WithEnvFunc(func(context.Context) (map[string]string, error) {
+			time.Sleep(50 * time.Millisecond)
+			return nil, nil
+		}),
+		WithWorkingDir(dir),
+	)
+	err := env.Run(context.Background(), "touch started")
+	if !errors.Is(err, ErrStartTimeout) {
+		t.Fatalf("Run() error = %v, want %v", err, ErrStartTimeout)
 	}
 
-	var stdout bytes.Buffer
-	env := Environment{
-		workingDir: "/tmp",
-		stdout:     &stdout,
+	if _, err := os.Stat(filepath.Join(dir, "started")); !os.IsNotExist(err) {
+		t.Errorf("script was started after the start timeout")
 	}
+}
 
-	for _, shell := range shells {
-		t.Run("WorkingDir_"+shell.Name(), func(t *testing.T) {
-			stdout.Reset()
-			env.shell = shell
-			if err := env.Run(context.Background(), "pwd"); err != nil {
-				t.Errorf("Run() error = %v", err)
-			}
+func TestStartTimeoutSlowStart(t *testing.T) {
+	defer func(start func(*exec.Cmd) error) { startCmd = start }(startCmd)
+	startCmd = func(cmd *exec.Cmd) error {
+		time.Sleep(50 * time.Millisecond)
+		return cmd.Start()
+	}
 
-			if stdout.String() != "/tmp\n" {
-				t.Errorf("Run() stdout = %v, want %v", stdout.String(), "/tmp")
-			}
-		})
+	dir := t.TempDir()
+	env := NewEnvironment(Bash(), WithStartTimeout(10*time.Millisecond), WithWorkingDir(dir))
+
+	err := env.Run(context.Background(), "sleep 0.2; touch started")
+	if !errors.Is(err, ErrStartTimeout) {
+		t.Fatalf("Run() error = %v, want %v", err, ErrStartTimeout)
+	}
+
+	// The script starts late and must be killed before it touches the file.
+	time.Sleep(500 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(dir, "started")); !os.IsNotExist(err) {
+		t.Errorf("script kept running after the start timeout")
 	}
 }
 
-func TestExportedShells(t *testing.T) {
-	for _, shell := range []Shell{Bash(), Sh()} {
-		if shell == nil {
-			t.Errorf("Shell %q is nil", shell.Name())
-		}
+func TestStderrBuffer(t *testing.T) {
+	b := &stderrBuffer{size: 4}
+	for _, s := range []string{"ab", "cdef", "g", "hijklm", "n"} {
+		b.Write([]byte(s))
+	}
+
+	if got, want := string(b.Bytes()), "abcd\n... omitting 6 bytes ...\nklmn"; got != want {
+		t.Errorf("Bytes() = %q, want %q", got, want)
+	}
+
+	b = &stderrBuffer{size: 4}
+	b.Write([]byte("abcdef"))
+	if got := string(b.Bytes()); got != "abcdef" {
+		t.Errorf("Bytes() = %q, want %q", got, "abcdef")
 	}
 }
 
-func TestSetDefaultEnvironment(t *testing.T) {
-	if defaultEnvironment.shell.Name() != Bash().Name() {
-		t.Errorf("defaultEnvironment.shell = %v, want %v", defaultEnvironment.shell.Name(), Bash().Name())
+func TestNoisyStderr(t *testing.T) {
+	env := NewEnvironment(Bash())
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err := env.Run(context.Background(), "head -c 100000000 /dev/zero >&2; exit 1")
+	runtime.ReadMemStats(&after)
+
+	var exitErr ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Run() error = %v, want ExitError", err)
+	}
+	if n := len(exitErr.Stderr()); n > 2*maxStderrSize+64 {
+		t.Errorf("Stderr() has %d bytes, want at most %d", n, 2*maxStderrSize+64)
 	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 10<<20 {
+		t.Errorf("Run() allocated %d bytes for the standard error", alloc)
+	}
+}
 
-	SetDefaultEnvironment(NewEnvironment(Sh()))
-	if defaultEnvironment.shell.Name() != Sh().Name() {
-		t.Errorf("defaultEnvironment.shell = %v, want %v", defaultEnvironment.shell.Name(), Sh().Name())
+func TestCaptureStderrOnError(t *testing.T) {
+	var stderr bytes.Buffer
+	env := NewEnvironment(Bash(), WithCaptureStderrOnError(), WithStderr(&stderr))
+
+	err := env.Run(context.Background(), "echo boom >&2; exit 2")
+	if err == nil {
+		t.Fatalf("Run() expected error, got nil")
+	}
+
+	if !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Run() error = %v, want to contain boom", err)
+	}
+
+	var exitErr ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Run() error = %T, want ExitError", err)
+	}
+	if exitErr.ExitCode() != 2 {
+		t.Errorf("ExitError.ExitCode() = %d, want 2", exitErr.ExitCode())
+	}
+	if string(exitErr.Stderr()) != "boom\n" {
+		t.Errorf("ExitError.Stderr() = %q, want %q", exitErr.Stderr(), "boom\n")
+	}
+
+	if stderr.String() != "boom\n" {
+		t.Errorf("Run() stderr = %q, want %q", stderr.String(), "boom\n")
+	}
+
+	out, err := env.CombinedOutput(context.Background(), "echo out; echo boom >&2; exit 2")
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("CombinedOutput() error = %v, want to contain boom", err)
+	}
+	// The streams are read from separate pipes, so their order may vary.
+	if got := string(out); got != "out\nboom\n" && got != "boom\nout\n" {
+		t.Errorf("CombinedOutput() = %q, want %q", out, "out\nboom\n")
+	}
+	if errors.As(err, &exitErr) && string(exitErr.Stderr()) != "boom\n" {
+		t.Errorf("ExitError.Stderr() = %q, want %q", exitErr.Stderr(), "boom\n")
+	}
+
+	// Only stderr is collected when it shares a writer with stdout.
+	var shared bytes.Buffer
+	env = NewEnvironment(Bash(), WithCaptureStderrOnError(), WithStdout(&shared), WithStderr(&shared))
+	err = env.Run(context.Background(), "echo STDOUT; echo STDERR >&2; exit 1")
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Run() error = %v, want ExitError", err)
+	}
+	if string(exitErr.Stderr()) != "STDERR\n" {
+		t.Errorf("ExitError.Stderr() = %q, want %q", exitErr.Stderr(), "STDERR\n")
+	}
+	if strings.Contains(err.Error(), "STDOUT") {
+		t.Errorf("Run() error = %v, want it not to contain stdout", err)
+	}
+	if got := shared.String(); !strings.Contains(got, "STDOUT\n") || !strings.Contains(got, "STDERR\n") {
+		t.Errorf("Run() output = %q, want both streams", got)
+	}
+}
+
+func TestCombinedWriter(t *testing.T) {
+	var combined, stdout bytes.Buffer
+	env := NewEnvironment(Bash(), WithCombinedWriter(&combined))
+
+	if err := env.Run(context.Background(), "echo a; echo b >&2; echo c"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if combined.String() != "a\nb\nc\n" {
+		t.Errorf("Run() combined = %q, want %q", combined.String(), "a\nb\nc\n")
+	}
+
+	combined.Reset()
+	env = NewEnvironment(Bash(), WithCombinedWriter(&combined), WithStdout(&stdout))
+	if err := env.Run(context.Background(), "echo a; echo b >&2"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := combined.String(); got != "a\nb\n" && got != "b\na\n" {
+		t.Errorf("Run() combined = %q, want both lines", got)
+	}
+	if stdout.String() != "a\n" {
+		t.Errorf("Run() stdout = %q, want %q", stdout.String(), "a\n")
+	}
+}
+
+func TestStartWait(t *testing.T) {
+	p, err := NewEnvironment(Bash()).Start(context.Background(), "sleep 5")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	if p.PID() <= 0 {
+		t.Errorf("PID() = %d, want positive pid", p.PID())
+	}
+
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Signal() error = %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		var exitErr ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("Wait() error = %v, want ExitError", err)
+		}
+		ws, ok := exitErr.err.Sys().(syscall.WaitStatus)
+		if !ok || ws.Signal() != syscall.SIGTERM {
+			t.Errorf("Wait() error = %v, want terminated by %v", err, syscall.SIGTERM)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Wait() did not return after SIGTERM")
+	}
+}
+
+func TestBeforeRun(t *testing.T) {
+	var args []string
+	env := NewEnvironment(Bash(), WithBeforeRun(func(cmd *exec.Cmd) {
+		args = cmd.Args
+	}))
+
+	script := "echo before run"
+	tt := map[string]func() error{
+		"Run": func() error {
+			return env.Run(context.Background(), script)
+		},
+		"Output": func() error {
+			_, err := env.Output(context.Background(), script)
+			return err
+		},
+		"CombinedOutput": func() error {
+			_, err := env.CombinedOutput(context.Background(), script)
+			return err
+		},
+	}
+
+	for name, run := range tt {
+		t.Run(name, func(t *testing.T) {
+			args = nil
+			if err := run(); err != nil {
+				t.Fatalf("%s() error = %v", name, err)
+			}
+
+			if !slices.Contains(args, script) {
+				t.Errorf("before run hook args = %v, want to contain %q", args, script)
+			}
+		})
+	}
+}
+
+func TestStream(t *testing.T) {
+	for _, shell := range commonShells() {
+		t.Run("Stream_"+shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+
+			var lines []string
+			err := NewEnvironment(shell).Stream(context.Background(), "echo 1; echo 2; echo 3", func(line string) {
+				lines = append(lines, line)
+			})
+			if err != nil {
+				t.Fatalf("Stream() error = %v", err)
+			}
+
+			want := []string{"1", "2", "3"}
+			if !slices.Equal(lines, want) {
+				t.Errorf("Stream() lines = %v, want %v", lines, want)
+			}
+		})
+	}
+
+	err := NewEnvironment(Bash()).Stream(context.Background(), "echo 1; exit 2", func(string) {})
+	var exitErr ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 2 {
+		t.Errorf("Stream() error = %v, want exit code 2", err)
+	}
+}
+
+func TestPerCallOptions(t *testing.T) {
+	var stdout, override bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&stdout))
+
+	if err := env.RunWith(context.Background(), "echo override", []Option{WithStdout(&override)}); err != nil {
+		t.Fatalf("RunWith() error = %v", err)
+	}
+
+	if err := env.Run(context.Background(), "echo default"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if override.String() != "override\n" {
+		t.Errorf("RunWith() stdout = %q, want %q", override.String(), "override\n")
+	}
+
+	if stdout.String() != "default\n" {
+		t.Errorf("Run() stdout = %q, want %q", stdout.String(), "default\n")
+	}
+
+	out, err := env.OutputWith(context.Background(), "echo $TEST_ENV", []Option{WithEnv(map[string]string{"TEST_ENV": "call"})})
+	if err != nil {
+		t.Fatalf("OutputWith() error = %v", err)
+	}
+	if string(out) != "call\n" {
+		t.Errorf("OutputWith() = %q, want %q", out, "call\n")
+	}
+	if env.env != nil {
+		t.Errorf("OutputWith() modified environment env = %v", env.env)
+	}
+}
+
+func TestPerCallOptionsBase(t *testing.T) {
+	env := NewEnvironment(Bash(), WithPathPrepend("/base/a"), WithPathPrepend("/base/b"), WithPathPrepend("/base/c"))
+	if cap(env.pathPrepend) == len(env.pathPrepend) {
+		t.Fatalf("pathPrepend has no spare capacity")
+	}
+	before := slices.Clone(env.pathPrepend[:cap(env.pathPrepend)])
+
+	for _, dir := range []string{"/first", "/second"} {
+		var stdout bytes.Buffer
+		err := env.RunWith(context.Background(), `printf '%s' "$PATH"`, []Option{WithStdout(&stdout), WithPathPrepend(dir)})
+		if err != nil {
+			t.Fatalf("RunWith() error = %v", err)
+		}
+		if !strings.HasPrefix(stdout.String(), "/base/a:/base/b:/base/c:"+dir+":") {
+			t.Errorf("RunWith() PATH = %q, want it to start with the base dirs and %s", stdout.String(), dir)
+		}
+	}
+
+	if after := env.pathPrepend[:cap(env.pathPrepend)]; !slices.Equal(after, before) {
+		t.Errorf("RunWith() modified the base environment: pathPrepend = %q, want %q", after, before)
+	}
+}
+
+func TestClone(t *testing.T) {
+	var stdout bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&stdout), WithEnv(map[string]string{
+		"TEST_ENV": "original",
+	}))
+
+	clone := env.Clone()
+	clone.env["TEST_ENV"] = "clone"
+	clone.env["TEST_CLONE"] = "clone"
+	clone.Apply(WithWorkingDir("/tmp"))
+
+	if env.env["TEST_ENV"] != "original" {
+		t.Errorf("original env[TEST_ENV] = %q, want %q", env.env["TEST_ENV"], "original")
+	}
+	if _, ok := env.env["TEST_CLONE"]; ok {
+		t.Errorf("original env contains TEST_CLONE")
+	}
+	if env.workingDir != "" {
+		t.Errorf("original workingDir = %q, want empty", env.workingDir)
+	}
+
+	if err := clone.Run(context.Background(), "echo $TEST_ENV $PWD"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if stdout.String() != "clone /tmp\n" {
+		t.Errorf("Run() stdout = %q, want %q", stdout.String(), "clone /tmp\n")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	env := NewEnvironment(Bash(), WithLogger(logger))
+
+	if err := env.Run(context.Background(), "exit 2", "TEST_ARG", "secret_value"); err == nil {
+		t.Fatalf("Run() expected error, got nil")
+	}
+
+	if strings.Contains(logs.String(), "secret_value") {
+		t.Errorf("logs contain the arg value: %s", logs.String())
+	}
+
+	var records []map[string]any
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var record map[string]any
+		if err := dec.Decode(&record); err != nil {
+			t.Fatalf("failed to decode log record: %v", err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("got %d log records, want 2", len(records))
+	}
+
+	started := records[0]
+	if started["msg"] != "command started" || started["shell"] != "bash" || started["script"] != "exit 2" {
+		t.Errorf("unexpected started record: %v", started)
+	}
+
+	finished := records[1]
+	if finished["msg"] != "command finished" {
+		t.Errorf("unexpected finished record: %v", finished)
+	}
+	if _, ok := finished["duration"]; !ok {
+		t.Errorf("finished record has no duration: %v", finished)
+	}
+	if finished["exit_code"] != float64(2) {
+		t.Errorf("finished record exit_code = %v, want 2", finished["exit_code"])
+	}
+	if _, ok := finished["error"]; !ok {
+		t.Errorf("finished record has no error: %v", finished)
+	}
+
+	logs.Reset()
+	env = NewEnvironment(Bash(), WithLogger(logger), WithLogArgValues())
+	if err := env.Run(context.Background(), "true", map[string]string{"MAP_ARG": "map_value"}, "TEST_ARG", "visible_value"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	for _, want := range []string{"MAP_ARG=map_value", "TEST_ARG=visible_value"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("logs do not contain %q: %s", want, logs.String())
+		}
+	}
+}
+
+func TestScanBufferSize(t *testing.T) {
+	script := `head -c 204800 /dev/zero | tr '\0' x; echo`
+
+	var lines []string
+	env := NewEnvironment(Sh(), WithScanBufferSize(1<<20))
+	err := env.Stream(context.Background(), script, func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatalf("Stream() error = %v", err)
+	}
+
+	if len(lines) != 1 || lines[0] != strings.Repeat("x", 204800) {
+		t.Errorf("Stream() got %d lines, want a single line of 204800 bytes", len(lines))
+	}
+
+	err = NewEnvironment(Sh()).Stream(context.Background(), script, func(string) {})
+	if !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("Stream() error = %v, want %v", err, bufio.ErrTooLong)
+	}
+}
+
+func TestRunStruct(t *testing.T) {
+	type config struct {
+		Host    string `sh:"APP_HOST"`
+		Port    int    `sh:"APP_PORT"`
+		Debug   bool
+		Skipped string `sh:"-"`
+		secret  string
+	}
+
+	var stdout bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&stdout))
+
+	cfg := config{Host: "localhost", Port: 8080, Debug: true, Skipped: "x", secret: "y"}
+	err := env.RunStruct(context.Background(), `echo "$APP_HOST:$APP_PORT $Debug ${Skipped-unset} ${secret-unset}"`, &cfg)
+	if err != nil {
+		t.Fatalf("RunStruct() error = %v", err)
+	}
+
+	if want := "localhost:8080 true unset unset\n"; stdout.String() != want {
+		t.Errorf("RunStruct() output = %q, want %q", stdout.String(), want)
+	}
+
+	if err := env.RunStruct(context.Background(), "true", "not a struct"); err == nil {
+		t.Errorf("RunStruct() expected error for a non-struct value, got nil")
+	}
+}
+
+func TestOutputDecoded(t *testing.T) {
+	env := NewEnvironment(Bash())
+
+	// "héllo" encoded as UTF-16LE with a byte order mark.
+	out, err := env.OutputDecoded(
+		context.Background(),
+		unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+		`printf '\xff\xfeh\x00\xe9\x00l\x00l\x00o\x00'`,
+	)
+	if err != nil {
+		t.Fatalf("OutputDecoded() error = %v", err)
+	}
+
+	if out != "héllo" {
+		t.Errorf("OutputDecoded() = %q, want %q", out, "héllo")
+	}
+}
+
+func TestStreamJSON(t *testing.T) {
+	env := NewEnvironment(Bash())
+
+	var objs []map[string]any
+	err := env.StreamJSON(context.Background(), `echo '{"id":1}'; echo; echo '{"id":2,"name":"b"}'`, func(obj json.RawMessage) error {
+		var v map[string]any
+		if err := json.Unmarshal(obj, &v); err != nil {
+			return err
+		}
+		objs = append(objs, v)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamJSON() error = %v", err)
+	}
+
+	if len(objs) != 2 || objs[0]["id"] != float64(1) || objs[1]["name"] != "b" {
+		t.Errorf("StreamJSON() objects = %v", objs)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	start := time.Now()
+	err = env.StreamJSON(context.Background(), `while true; do echo '{}'; sleep 0.01; done`, func(json.RawMessage) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || calls != 1 {
+		t.Errorf("StreamJSON() = %v after %d calls, want %v after 1 call", err, calls, errStop)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("StreamJSON() did not stop the script")
+	}
+
+	err = env.StreamJSON(context.Background(), "echo not json", func(json.RawMessage) error { return nil })
+	if err == nil {
+		t.Errorf("StreamJSON() expected error for invalid JSON, got nil")
+	}
+}
+
+func TestStreamBoth(t *testing.T) {
+	var stdout, stderr []string
+	err := NewEnvironment(Bash()).StreamBoth(
+		context.Background(),
+		"for i in 1 2 3; do echo out$i; echo err$i >&2; done",
+		func(line string) { stdout = append(stdout, line) },
+		func(line string) { stderr = append(stderr, line) },
+	)
+	if err != nil {
+		t.Fatalf("StreamBoth() error = %v", err)
+	}
+
+	if want := []string{"out1", "out2", "out3"}; !slices.Equal(stdout, want) {
+		t.Errorf("stdout lines = %q, want %q", stdout, want)
+	}
+	if want := []string{"err1", "err2", "err3"}; !slices.Equal(stderr, want) {
+		t.Errorf("stderr lines = %q, want %q", stderr, want)
+	}
+}
+
+func TestSecretArg(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	env := NewEnvironment(Bash(), WithLogger(logger), WithLogArgValues())
+
+	out, err := env.Output(context.Background(), "echo $TOKEN", SecretArg{Key: "TOKEN", Value: "hunter2"})
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if string(out) != "hunter2\n" {
+		t.Errorf("Output() = %q, want %q", out, "hunter2\n")
+	}
+
+	if strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("logs contain the secret value: %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "TOKEN=***") {
+		t.Errorf("logs do not contain the secret key: %s", logs.String())
+	}
+
+	for _, shell := range []Shell{Bash(), DockerExec("app", Sh())} {
+		dry, err := NewEnvironment(shell).DryRun(context.Background(), "echo $TOKEN", SecretArg{Key: "TOKEN", Value: "hunter2"})
+		if err != nil {
+			t.Fatalf("DryRun() error = %v", err)
+		}
+		if strings.Contains(dry, "hunter2") || !strings.Contains(dry, "TOKEN=") {
+			t.Errorf("DryRun() = %q, want the secret value redacted", dry)
+		}
+	}
+}
+
+func TestTerminateKill(t *testing.T) {
+	tt := map[string]struct {
+		stop   func(p *Process) error
+		signal syscall.Signal
+	}{
+		"Terminate": {
+			stop:   (*Process).Terminate,
+			signal: syscall.SIGTERM,
+		},
+		"Kill": {
+			stop:   (*Process).Kill,
+			signal: syscall.SIGKILL,
+		},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			p, err := NewEnvironment(Bash()).Start(context.Background(), "sleep 30")
+			if err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+
+			if err := tc.stop(p); err != nil {
+				t.Fatalf("%s() error = %v", name, err)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- p.Wait()
+			}()
+
+			select {
+			case err := <-done:
+				var exitErr ExitError
+				if !errors.As(err, &exitErr) {
+					t.Fatalf("Wait() error = %v, want ExitError", err)
+				}
+				ws, ok := exitErr.err.Sys().(syscall.WaitStatus)
+				if !ok || ws.Signal() != tc.signal {
+					t.Errorf("Wait() error = %v, want terminated by %v", err, tc.signal)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Wait() did not return after %s()", name)
+			}
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	dir := t.TempDir()
+	input := "a'b; touch pwned"
+
+	if got, want := Quote(input), `'a'\''b; touch pwned'`; got != want {
+		t.Errorf("Quote() = %v, want %v", got, want)
+	}
+
+	for _, shell := range posixShells() {
+		t.Run(shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+
+			env := NewEnvironment(shell, WithWorkingDir(dir))
+			out, err := env.Output(context.Background(), fmt.Sprintf("echo %s", Quote(input)))
+			if err != nil {
+				t.Fatalf("Output() error = %v", err)
+			}
+
+			if string(out) != input+"\n" {
+				t.Errorf("Output() = %q, want %q", out, input+"\n")
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+				t.Errorf("quoted input was executed")
+			}
+		})
+	}
+}
+
+func TestDedent(t *testing.T) {
+	script := `
+		case "$1" in
+		a)
+			echo first
+			;;
+		esac
+			
+		cat <<EOF
+		done
+		EOF
+	`
+
+	want := "\ncase \"$1\" in\na)\n\techo first\n\t;;\nesac\n\ncat <<EOF\ndone\nEOF\n"
+	got := Dedent(script)
+	if got != want {
+		t.Fatalf("Dedent() = %q, want %q", got, want)
+	}
+
+	out, err := NewEnvironment(Bash()).Output(context.Background(), got, Positional("a"))
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if string(out) != "first\ndone\n" {
+		t.Errorf("Output() = %q, want %q", out, "first\ndone\n")
+	}
+}
+
+func TestPathPrependAppend(t *testing.T) {
+	env := NewEnvironment(
+		Bash(),
+		WithEnv(map[string]string{"PATH": "/usr/bin:/bin"}),
+		WithPathPrepend("/custom/bin"),
+		WithPathAppend("/last/bin"),
+	)
+
+	out, err := env.OutputString(context.Background(), "echo $PATH")
+	if err != nil {
+		t.Fatalf("OutputString() error = %v", err)
+	}
+
+	if want := "/custom/bin:/usr/bin:/bin:/last/bin"; out != want {
+		t.Errorf("OutputString() = %q, want %q", out, want)
+	}
+
+	out, err = NewEnvironment(Bash(), WithPathPrepend("/custom/bin")).OutputString(context.Background(), "echo $PATH")
+	if err != nil {
+		t.Fatalf("OutputString() error = %v", err)
+	}
+
+	if want := "/custom/bin:" + os.Getenv("PATH"); out != want {
+		t.Errorf("OutputString() = %q, want %q", out, want)
+	}
+}
+
+func TestEnvKeyCase(t *testing.T) {
+	defer func(v bool) { caseInsensitiveEnv = v }(caseInsensitiveEnv)
+	sep := string(os.PathListSeparator)
+
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		base            []string
+		want            []string
+	}{
+		{
+			name:            "case-insensitive Path",
+			caseInsensitive: true,
+			base:            []string{"Path=/usr/bin", "HOME=/root"},
+			want:            []string{"HOME=/root", "PATH=/custom/bin" + sep + "/usr/bin"},
+		},
+		{
+			name:            "case-insensitive PATH",
+			caseInsensitive: true,
+			base:            []string{"PATH=/usr/bin", "HOME=/root"},
+			want:            []string{"HOME=/root", "PATH=/custom/bin" + sep + "/usr/bin"},
+		},
+		{
+			name:            "case-sensitive Path",
+			caseInsensitive: false,
+			base:            []string{"Path=/usr/bin", "HOME=/root"},
+			want:            []string{"HOME=/root", "PATH=/custom/bin", "Path=/usr/bin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caseInsensitiveEnv = tt.caseInsensitive
+
+			env := NewEnvironment(Bash(), WithRawEnv(tt.base), WithPathPrepend("/custom/bin"))
+			defer env.cleanup()
+
+			cmd, err := env.command(context.Background(), source{script: "true"})
+			if err != nil {
+				t.Fatalf("command() error = %v", err)
+			}
+
+			got := slices.Clone(cmd.Env)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("command() env = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	var want strings.Builder
+	for i := 1; i <= 3000; i++ {
+		fmt.Fprintf(&want, "%d\n", i)
+	}
+	tail := want.String()[want.Len()-1024:]
+
+	env := NewEnvironment(Bash(), WithTailBuffer(1024))
+	err := env.Run(context.Background(), "seq 1 3000; exit 3")
+
+	var exitErr ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("Run() error = %v, want ExitError", err)
+	}
+	if string(exitErr.Tail()) != tail {
+		t.Errorf("Tail() = %q, want %q", exitErr.Tail(), tail)
+	}
+
+	out, err := env.CombinedOutput(context.Background(), "echo out; echo err >&2")
+	if err != nil {
+		t.Fatalf("CombinedOutput() error = %v", err)
+	}
+	if string(out) != "out\nerr\n" {
+		t.Errorf("CombinedOutput() = %q, want %q", out, "out\nerr\n")
+	}
+
+	p, err := env.Start(context.Background(), "echo err >&2")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if string(p.Tail()) != "err\n" {
+		t.Errorf("Tail() = %q, want %q", p.Tail(), "err\n")
+	}
+}
+
+func TestOnExit(t *testing.T) {
+	var code int
+	var exitErr error
+	env := NewEnvironment(Bash(), WithOnExit(func(c int, err error) {
+		code, exitErr = c, err
+	}))
+
+	if err := env.Run(context.Background(), "exit 7"); err == nil {
+		t.Fatalf("Run() expected error, got nil")
+	}
+	if code != 7 || exitErr == nil {
+		t.Errorf("WithOnExit() got %d, %v, want 7 and an error", code, exitErr)
+	}
+
+	if _, err := env.Output(context.Background(), "echo ok"); err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if code != 0 || exitErr != nil {
+		t.Errorf("WithOnExit() got %d, %v, want 0 and no error", code, exitErr)
+	}
+
+	env = NewEnvironment(BashAt("/nonexistent/bash"), WithOnExit(func(c int, err error) {
+		code, exitErr = c, err
+	}))
+	if err := env.Run(context.Background(), "true"); err == nil {
+		t.Fatalf("Run() expected error, got nil")
+	}
+	if code != -1 || exitErr == nil {
+		t.Errorf("WithOnExit() got %d, %v, want -1 and an error", code, exitErr)
+	}
+
+	// The callback is also called when the command cannot be built.
+	tests := []struct {
+		name string
+		env  *Environment
+		args []any
+	}{
+		{"invalid argument", NewEnvironment(Bash()), []any{Arg{Key: "A=B", Value: "x"}}},
+		{"no shell", NewEnvironment(nil), nil},
+		{"bad working dir", NewEnvironment(Bash(), WithWorkingDir("/nonexistent/dir")), nil},
+	}
+	for _, tt := range tests {
+		code, exitErr = 0, nil
+		tt.env.Apply(WithOnExit(func(c int, err error) {
+			code, exitErr = c, err
+		}))
+		if err := tt.env.Run(context.Background(), "true", tt.args...); err == nil {
+			t.Fatalf("%s: Run() expected error, got nil", tt.name)
+		}
+		if code != -1 || exitErr == nil {
+			t.Errorf("%s: WithOnExit() got %d, %v, want -1 and an error", tt.name, code, exitErr)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	var timed time.Duration
+	env := NewEnvironment(Sh(), WithTimingCallback(func(d time.Duration) {
+		timed = d
+	}))
+
+	result, err := env.Result(context.Background(), "sleep 0.1")
+	if err != nil {
+		t.Fatalf("Result() error = %v", err)
+	}
+
+	if result.Duration < 100*time.Millisecond {
+		t.Errorf("Result() duration = %v, want at least 100ms", result.Duration)
+	}
+	if timed != result.Duration {
+		t.Errorf("timing callback got %v, want %v", timed, result.Duration)
+	}
+}
+
+func TestSimple(t *testing.T) {
+	if err := RunSimple("true"); err != nil {
+		t.Errorf("RunSimple(true) error = %v", err)
+	}
+	if err := RunSimple("false"); err == nil {
+		t.Errorf("RunSimple(false) expected error, got nil")
+	}
+
+	out, err := OutputSimple("echo $FOO", "FOO", "bar")
+	if err != nil {
+		t.Fatalf("OutputSimple() error = %v", err)
+	}
+	if string(out) != "bar\n" {
+		t.Errorf("OutputSimple() = %q, want %q", out, "bar\n")
+	}
+}
+
+func TestShellByName(t *testing.T) {
+	for _, want := range []Shell{Bash(), Sh(), Zsh(), Fish(), Dash(), Ksh(), Ash(), PowerShell(), Cmd()} {
+		got, err := ShellByName(want.Name())
+		if err != nil {
+			t.Fatalf("ShellByName(%q) error = %v", want.Name(), err)
+		}
+		if got.Name() != want.Name() {
+			t.Errorf("ShellByName(%q).Name() = %q", want.Name(), got.Name())
+		}
+	}
+
+	if _, err := ShellByName("nonsense"); err == nil {
+		t.Errorf("ShellByName(%q) expected error, got nil", "nonsense")
+	}
+}
+
+type fakeShell struct{ sh }
+
+func TestRegisterShell(t *testing.T) {
+	RegisterShell("myshell", func() Shell { return &fakeShell{} })
+	t.Cleanup(func() {
+		shellsMu.Lock()
+		delete(shells, "myshell")
+		shellsMu.Unlock()
+	})
+
+	shell, err := ShellByName("myshell")
+	if err != nil {
+		t.Fatalf("ShellByName() error = %v", err)
+	}
+	if _, ok := shell.(*fakeShell); !ok {
+		t.Errorf("ShellByName() = %T, want *fakeShell", shell)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			RegisterShell("myshell", func() Shell { return &fakeShell{} })
+		}()
+		go func() {
+			defer wg.Done()
+			ShellByName("myshell")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMust(t *testing.T) {
+	ctx := context.Background()
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("MustRun() did not panic")
+			}
+		}()
+		MustRun(ctx, "exit 1")
+	}()
+
+	MustRun(ctx, "true")
+
+	if out := MustOutput(ctx, "echo hello"); string(out) != "hello\n" {
+		t.Errorf("MustOutput() = %q, want %q", out, "hello\n")
+	}
+}
+
+func TestEnvFunc(t *testing.T) {
+	env := NewEnvironment(Bash(), WithEnvFunc(func(ctx context.Context) (map[string]string, error) {
+		return map[string]string{"NOW": strconv.FormatInt(time.Now().Unix(), 10)}, nil
+	}))
+
+	before := time.Now().Unix()
+	out, err := env.OutputString(context.Background(), "echo $NOW")
+	if err != nil {
+		t.Fatalf("OutputString() error = %v", err)
+	}
+
+	now, err := strconv.ParseInt(out, 10, 64)
+	if err != nil {
+		t.Fatalf("OutputString() = %q, want a unix time", out)
+	}
+	if now < before || now > time.Now().Unix() {
+		t.Errorf("NOW = %d, want between %d and now", now, before)
+	}
+
+	errToken := errors.New("token expired")
+	env.Apply(WithEnvFunc(func(ctx context.Context) (map[string]string, error) {
+		return nil, errToken
+	}))
+	if err := env.Run(context.Background(), "true"); !errors.Is(err, errToken) {
+		t.Errorf("Run() error = %v, want %v", err, errToken)
+	}
+}
+
+type traceIDKey struct{}
+
+func TestTraceEnv(t *testing.T) {
+	env := NewEnvironment(Bash(), WithTraceEnv("TRACE_ID", func(ctx context.Context) string {
+		id, _ := ctx.Value(traceIDKey{}).(string)
+		return id
+	}))
+
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "4bf92f3577b34da6")
+	out, err := env.OutputString(ctx, "echo $TRACE_ID")
+	if err != nil {
+		t.Fatalf("OutputString() error = %v", err)
+	}
+	if out != "4bf92f3577b34da6" {
+		t.Errorf("OutputString() = %q, want %q", out, "4bf92f3577b34da6")
+	}
+
+	out, err = env.OutputString(context.Background(), "echo ${TRACE_ID-unset}")
+	if err != nil {
+		t.Fatalf("OutputString() error = %v", err)
+	}
+	if out != "unset" {
+		t.Errorf("OutputString() without a trace ID = %q, want %q", out, "unset")
+	}
+}
+
+func TestMapArg(t *testing.T) {
+	env := NewEnvironment(Bash())
+
+	out, err := env.Output(context.Background(), `echo "$A $B"`, map[string]string{"A": "1", "B": "2"})
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if string(out) != "1 2\n" {
+		t.Errorf("Output() = %q, want %q", out, "1 2\n")
+	}
+
+	out, err = env.Output(context.Background(), `echo "$A $B $1"`, map[string]string{"A": "1"}, "B", "3", Positional("p"))
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if string(out) != "1 3 p\n" {
+		t.Errorf("Output() = %q, want %q", out, "1 3 p\n")
+	}
+
+	if err := env.Run(context.Background(), "true", map[string]string{"A=B": "x"}); err == nil {
+		t.Errorf("Run() expected error for an invalid name, got nil")
+	}
+}
+
+func TestDiscardOutput(t *testing.T) {
+	var stdout, stderr, combined bytes.Buffer
+	env := NewEnvironment(
+		Bash(),
+		WithStdout(&stdout),
+		WithStderr(&stderr),
+		WithCombinedWriter(&combined),
+		WithDiscardOutput(),
+	)
+
+	if err := env.Run(context.Background(), "echo leak; echo leak >&2"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if stdout.Len() > 0 || stderr.Len() > 0 || combined.Len() > 0 {
+		t.Errorf("Run() wrote %q, %q, %q, want no output", stdout.String(), stderr.String(), combined.String())
+	}
+
+	cmd, err := env.command(context.Background(), source{script: "echo leak"})
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+	if cmd.Stdout != io.Discard || cmd.Stderr != io.Discard {
+		t.Errorf("command() stdout = %v, stderr = %v, want io.Discard", cmd.Stdout, cmd.Stderr)
+	}
+	env.cleanup()
+
+	out, err := env.Output(context.Background(), "echo kept")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if string(out) != "kept\n" {
+		t.Errorf("Output() = %q, want %q", out, "kept\n")
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	var allocated int
+	pool := &sync.Pool{New: func() any {
+		allocated++
+		return new(bytes.Buffer)
+	}}
+	env := NewEnvironment(Bash(), WithBufferPool(pool))
+
+	first, err := env.Output(context.Background(), "echo first")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	second, err := env.CombinedOutput(context.Background(), "echo second >&2")
+	if err != nil {
+		t.Fatalf("CombinedOutput() error = %v", err)
+	}
+
+	if string(first) != "first\n" || string(second) != "second\n" {
+		t.Errorf("outputs = %q, %q, want %q, %q", first, second, "first\n", "second\n")
+	}
+	if allocated == 0 {
+		t.Errorf("the buffer pool was not used")
+	}
+
+	allocated = 0
+	pool = &sync.Pool{New: func() any {
+		allocated++
+		return new(bytes.Buffer)
+	}}
+	result, err := NewEnvironment(Bash(), WithBufferPool(pool)).Result(context.Background(), "echo third")
+	if err != nil {
+		t.Fatalf("Result() error = %v", err)
+	}
+	if string(result.Stdout) != "third\n" {
+		t.Errorf("Result().Stdout = %q, want %q", result.Stdout, "third\n")
+	}
+	if allocated == 0 {
+		t.Errorf("the buffer pool was not used by Result")
+	}
+}
+
+func BenchmarkOutputBuffer(b *testing.B) {
+	chunk := bytes.Repeat([]byte("x"), 512)
+
+	for name, pool := range map[string]*sync.Pool{
+		"pooled":   &outputBufferPool,
+		"unpooled": nil,
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf := newOutputBuffer(pool, 0, nil)
+				for j := 0; j < 32; j++ {
+					buf.Write(chunk)
+				}
+				buf.result(nil)
+			}
+		})
+	}
+}
+
+func BenchmarkOutput(b *testing.B) {
+	env := NewEnvironment(Sh())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := env.Output(context.Background(), "echo hello"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestOutputLines(t *testing.T) {
+	tt := []struct {
+		script string
+		sep    byte
+		want   []string
+	}{
+		{script: `printf 'a\0b c\0'`, sep: 0, want: []string{"a", "b c"}},
+		{script: `printf 'a\nb'`, sep: '\n', want: []string{"a", "b"}},
+		{script: `printf 'a\n\nb\n'`, sep: '\n', want: []string{"a", "", "b"}},
+		{script: "true", sep: '\n', want: nil},
+	}
+
+	env := NewEnvironment(Bash())
+	for _, tc := range tt {
+		t.Run(tc.script, func(t *testing.T) {
+			got, err := env.OutputLines(context.Background(), tc.script, tc.sep)
+			if err != nil {
+				t.Fatalf("OutputLines() error = %v", err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("OutputLines() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOutputJSON(t *testing.T) {
+	env := NewEnvironment(Bash())
+
+	var got map[string]int
+	if err := env.OutputJSON(context.Background(), &got, `echo '{"a":1}'`); err != nil {
+		t.Fatalf("OutputJSON() error = %v", err)
+	}
+	if got["a"] != 1 {
+		t.Errorf("OutputJSON() = %v, want a = 1", got)
+	}
+
+	err := env.OutputJSON(context.Background(), &got, "echo not json")
+	if err == nil || !strings.Contains(err.Error(), "not json") {
+		t.Errorf("OutputJSON() error = %v, want error including the output", err)
+	}
+}
+
+func TestOutputCode(t *testing.T) {
+	env := NewEnvironment(Bash())
+
+	out, code, err := env.OutputCode(context.Background(), "echo hi; exit 4")
+	if err != nil {
+		t.Fatalf("OutputCode() error = %v", err)
+	}
+	if string(out) != "hi\n" {
+		t.Errorf("OutputCode() output = %q, want %q", out, "hi\n")
+	}
+	if code != 4 {
+		t.Errorf("OutputCode() code = %d, want 4", code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, code, err := env.OutputCode(ctx, "echo hi"); err == nil || code != -1 {
+		t.Errorf("OutputCode() = %d, %v, want -1 and an error", code, err)
+	}
+}
+
+func TestWhich(t *testing.T) {
+	for _, shell := range posixShells() {
+		t.Run(shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+
+			env := NewEnvironment(shell)
+			path, err := env.Which(context.Background(), "echo")
+			if err != nil {
+				t.Fatalf("Which() error = %v", err)
+			}
+			if path == "" {
+				t.Errorf("Which() returned an empty path")
+			}
+
+			_, err = env.Which(context.Background(), "definitely-not-a-command")
+			if !errors.Is(err, ErrCommandNotFound) {
+				t.Errorf("Which() error = %v, want %v", err, ErrCommandNotFound)
+			}
+		})
+	}
+}
+
+// failingWriter accepts n bytes and then fails with err.
+type failingWriter struct {
+	n   int
+	err error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, w.err
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriterFailed(t *testing.T) {
+	errClosed := errors.New("connection closed")
+
+	for name, opt := range map[string]func(io.Writer) Option{
+		"stdout":   WithStdout,
+		"combined": WithCombinedWriter,
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := NewEnvironment(Bash(), opt(&failingWriter{n: 10, err: errClosed}))
+
+			err := env.Run(context.Background(), "for i in $(seq 1000); do echo line $i; done")
+			if !errors.Is(err, ErrWriterFailed) || !errors.Is(err, errClosed) {
+				t.Errorf("Run() error = %v, want %v wrapping %v", err, ErrWriterFailed, errClosed)
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&out), WithStderr(&out))
+	if err := env.Run(context.Background(), "echo out; exit 3"); errors.Is(err, ErrWriterFailed) {
+		t.Errorf("Run() error = %v, want an exit error", err)
+	}
+}
+
+func TestRunArgs(t *testing.T) {
+	var out bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&out))
+
+	if err := env.RunArgs(context.Background(), `echo "$A $B"`, Arg{"A", "1"}, Arg{"B", "two"}); err != nil {
+		t.Fatalf("RunArgs() error = %v", err)
+	}
+
+	if out.String() != "1 two\n" {
+		t.Errorf("RunArgs() output = %q, want %q", out.String(), "1 two\n")
+	}
+}
+
+func TestRunReader(t *testing.T) {
+	script := `echo "first $1"
+for i in 1 2; do
+	echo "line $i $FOO"
+done
+`
+
+	for _, shell := range posixShells() {
+		t.Run(shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+
+			var out bytes.Buffer
+			env := NewEnvironment(shell, WithStdout(&out), WithStrictMode())
+			if err := env.RunReader(context.Background(), strings.NewReader(script), "FOO", "bar", Positional("arg")); err != nil {
+				t.Fatalf("RunReader() error = %v", err)
+			}
+
+			want := "first arg\nline 1 bar\nline 2 bar\n"
+			if out.String() != want {
+				t.Errorf("RunReader() output = %q, want %q", out.String(), want)
+			}
+		})
+	}
+
+	err := NewEnvironment(Cmd()).RunReader(context.Background(), strings.NewReader("echo hi"))
+	if !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("RunReader() error = %v, want %v", err, errors.ErrUnsupported)
+	}
+}
+
+func TestNewEnvironmentStrict(t *testing.T) {
+	if _, err := NewEnvironmentStrict(Bash()); err != nil {
+		t.Errorf("NewEnvironmentStrict(bash) error = %v", err)
+	}
+
+	_, err := NewEnvironmentStrict(BashAt("/nonexistent/bash"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("NewEnvironmentStrict() error = %v, want %v", err, fs.ErrNotExist)
+	}
+
+	if _, err := NewEnvironmentStrict(nil); !errors.Is(err, ErrNoShell) {
+		t.Errorf("NewEnvironmentStrict(nil) error = %v, want %v", err, ErrNoShell)
+	}
+}
+
+func TestInheritOnly(t *testing.T) {
+	t.Setenv("SH_TEST_SECRET", "secret")
+	t.Setenv("HOME", "/home/test")
+
+	env := NewEnvironment(Bash(), WithInheritOnly("HOME", "SH_TEST_UNSET"), WithEnv(map[string]string{"FROM_ENV": "env"}))
+	out, err := env.Output(context.Background(), `echo "$HOME|$SH_TEST_SECRET|$FROM_ENV|$FOO"`, "FOO", "arg")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if want := "/home/test||env|arg\n"; string(out) != want {
+		t.Errorf("Output() = %q, want %q", out, want)
+	}
+
+	dry, err := env.DryRun(context.Background(), "true")
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	if !strings.HasPrefix(dry, "env -i ") || strings.Contains(dry, "secret") {
+		t.Errorf("DryRun() = %q, want only the allowed variables", dry)
+	}
+}
+
+func TestStdioFiles(t *testing.T) {
+	dir := t.TempDir()
+	create := func(name string) *os.File {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+
+	in := create("stdin")
+	if _, err := in.WriteString("input\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	out := create("stdout")
+	errOut := create("stderr")
+
+	var ignored bytes.Buffer
+	env := NewEnvironment(
+		Bash(),
+		WithStdin(strings.NewReader("ignored\n")),
+		WithStdout(&ignored),
+		WithStdinFile(in),
+		WithStdoutFile(out),
+		WithStderrFile(errOut),
+	)
+
+	cmd, err := env.command(context.Background(), source{script: "true"})
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+	env.cleanup()
+	if cmd.Stdin != in || cmd.Stdout != out || cmd.Stderr != errOut {
+		t.Errorf("command() does not use the files directly")
+	}
+
+	if err := env.Run(context.Background(), "read -r x; echo out $x; echo err >&2"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	for name, want := range map[string]string{"stdout": "out input\n", "stderr": "err\n"} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if ignored.Len() > 0 {
+		t.Errorf("WithStdout() writer got %q, want no output", ignored.String())
+	}
+}
+
+func TestDefaultStdin(t *testing.T) {
+	env := NewEnvironment(Bash(), WithTimeout(5*time.Second))
+
+	out, err := env.OutputString(context.Background(), "read -r x; echo done $?")
+	if err != nil {
+		t.Fatalf("OutputString() error = %v", err)
+	}
+	if out != "done 1" {
+		t.Errorf("OutputString() = %q, want %q", out, "done 1")
+	}
+
+	env.Apply(WithInheritStdin())
+	cmd, err := env.command(context.Background(), source{script: "true"})
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+	env.cleanup()
+	if cmd.Stdin != os.Stdin {
+		t.Errorf("command() stdin = %v, want os.Stdin", cmd.Stdin)
+	}
+}
+
+func TestExpandArgs(t *testing.T) {
+	env := NewEnvironment(Bash(), WithEnv(map[string]string{"HOME": "/h"}), WithExpandArgs())
+
+	out, err := env.Output(
+		context.Background(),
+		`echo "$LOG $NAME $LITERAL"`,
+		Arg{"LOG", "$HOME/log"},
+		"NAME", "${LOG}.txt",
+		Arg{"LITERAL", "$UNSET_VARIABLE"},
+	)
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if want := "/h/log /h/log.txt \n"; string(out) != want {
+		t.Errorf("Output() = %q, want %q", out, want)
+	}
+
+	out, err = NewEnvironment(Bash(), WithEnv(map[string]string{"HOME": "/h"})).Output(context.Background(), `echo "$LOG"`, Arg{"LOG", "$HOME/log"})
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+	if want := "$HOME/log\n"; string(out) != want {
+		t.Errorf("Output() without expansion = %q, want %q", out, want)
+	}
+}
+
+func TestRawEnv(t *testing.T) {
+	t.Setenv("SH_TEST_INHERITED", "inherited")
+
+	env := NewEnvironment(
+		Bash(),
+		WithRawEnv([]string{"RAW_ONE=1", "RAW_TWO=two words", "OVERRIDE=raw"}),
+		WithEnv(map[string]string{"OVERRIDE": "env"}),
+	)
+
+	out, err := env.Output(context.Background(), `echo "$RAW_ONE|$RAW_TWO|$OVERRIDE|$SH_TEST_INHERITED"`)
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if want := "1|two words|env|\n"; string(out) != want {
+		t.Errorf("Output() = %q, want %q", out, want)
+	}
+
+	cmd, err := NewEnvironment(Bash(), WithRawEnv([]string{"A=1", "B=2"})).command(context.Background(), source{script: "true"})
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+	if want := []string{"A=1", "B=2"}; !slices.Equal(cmd.Env, want) {
+		t.Errorf("command() env = %q, want %q", cmd.Env, want)
+	}
+
+	// The raw env is not dropped by WithCleanEnv, whatever the order.
+	for _, opts := range [][]Option{
+		{WithCleanEnv(), WithRawEnv([]string{"A=1"})},
+		{WithRawEnv([]string{"A=1"}), WithCleanEnv()},
+	} {
+		out, err := NewEnvironment(Bash(), opts...).OutputString(context.Background(), `echo "$A|$SH_TEST_INHERITED"`)
+		if err != nil {
+			t.Fatalf("OutputString() error = %v", err)
+		}
+		if want := "1|"; out != want {
+			t.Errorf("OutputString() = %q, want %q", out, want)
+		}
+	}
+}
+
+func TestUnsetEnv(t *testing.T) {
+	t.Setenv("FOO", "inherited")
+	t.Setenv("SH_TEST_KEPT", "kept")
+
+	env := NewEnvironment(
+		Bash(),
+		WithEnv(map[string]string{"BAR": "env"}),
+		WithUnsetEnv("FOO", "BAR", "BAZ"),
+	)
+
+	out, err := env.Output(context.Background(), "env", "BAZ", "arg")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "FOO=") || strings.HasPrefix(line, "BAR=") || strings.HasPrefix(line, "BAZ=") {
+			t.Errorf("env contains %q", line)
+		}
+	}
+	if !strings.Contains(string(out), "SH_TEST_KEPT=kept\n") {
+		t.Errorf("env does not contain SH_TEST_KEPT")
+	}
+
+	ssh := NewEnvironment(SSH("example.com"), WithEnv(map[string]string{"BAR": "env", "KEPT": "1"}), WithUnsetEnv("BAR"))
+	cmd, err := ssh.command(context.Background(), source{script: "true"})
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+	if remote := cmd.Args[len(cmd.Args)-1]; strings.Contains(remote, "BAR=") || !strings.Contains(remote, "KEPT=1") {
+		t.Errorf("remote command = %q, want BAR unset", remote)
+	}
+}
+
+func TestSuccessCodes(t *testing.T) {
+	env := NewEnvironment(Bash(), WithSuccessCodes(1))
+
+	if err := env.Run(context.Background(), "exit 1"); err != nil {
+		t.Errorf("Run(exit 1) error = %v", err)
+	}
+
+	out, err := env.Output(context.Background(), "echo differs; exit 1")
+	if err != nil || string(out) != "differs\n" {
+		t.Errorf("Output() = %q, %v, want %q", out, err, "differs\n")
+	}
+
+	var exitErr ExitError
+	if err := env.Run(context.Background(), "exit 2"); !errors.As(err, &exitErr) || exitErr.ExitCode() != 2 {
+		t.Errorf("Run(exit 2) error = %v, want exit code 2", err)
+	}
+}
+
+func TestRunAll(t *testing.T) {
+	dir := t.TempDir()
+	env := NewEnvironment(Bash(), WithWorkingDir(dir))
+
+	err := env.RunAll(context.Background(), "true", "exit 2 # TOKEN", "touch ran")
+	if err == nil {
+		t.Fatalf("RunAll() expected error, got nil")
+	}
+	if !strings.Contains(err.Error(), "script 1") {
+		t.Errorf("RunAll() error = %v, want it to mention script 1", err)
+	}
+	if strings.Contains(err.Error(), "TOKEN") {
+		t.Errorf("RunAll() error = %v, contains the script", err)
+	}
+
+	var exitErr ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 2 {
+		t.Errorf("RunAll() error = %v, want exit code 2", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "ran")); err == nil {
+		t.Errorf("RunAll() ran the scripts after the failed one")
+	}
+
+	if err := env.RunAll(context.Background(), "true", "true"); err != nil {
+		t.Errorf("RunAll() error = %v", err)
+	}
+}
+
+func TestRunParallel(t *testing.T) {
+	dir := t.TempDir()
+	env := NewEnvironment(Sh(), WithWorkingDir(dir))
+
+	// Each script records how many scripts were running when it started.
+	var scripts []string
+	for i := 0; i < 10; i++ {
+		scripts = append(scripts, fmt.Sprintf(`touch running.%d; ls running.* | wc -l > count.%d; sleep 0.05; rm running.%d`, i, i, i))
+	}
+
+	if err := env.RunParallel(context.Background(), 3, scripts...); err != nil {
+		t.Fatalf("RunParallel() error = %v", err)
+	}
+
+	for i := range scripts {
+		out, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("count.%d", i)))
+		if err != nil {
+			t.Fatalf("script %d did not run: %v", i, err)
+		}
+		if n, _ := strconv.Atoi(strings.TrimSpace(string(out))); n < 1 || n > 3 {
+			t.Errorf("script %d ran along with %d scripts, want at most 3", i, n)
+		}
+	}
+
+	err := env.RunParallel(context.Background(), 2, "true", "exit 3", "exit 4 # TOKEN")
+	if err == nil || !strings.Contains(err.Error(), "script 1") || !strings.Contains(err.Error(), "script 2") {
+		t.Errorf("RunParallel() error = %v, want errors of scripts 1 and 2", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "TOKEN") {
+		t.Errorf("RunParallel() error = %v, contains the script", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := env.RunParallel(ctx, 1, "true"); !errors.Is(err, context.Canceled) {
+		t.Errorf("RunParallel() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRunTemplate(t *testing.T) {
+	var out bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&out))
+
+	data := struct{ Name string }{Name: "two words; echo injected"}
+	err := env.RunTemplate(context.Background(), `printf '%s|' {{ .Name | quote }} "$EXTRA"`, data, "EXTRA", "extra")
+	if err != nil {
+		t.Fatalf("RunTemplate() error = %v", err)
+	}
+
+	if want := "two words; echo injected|extra|"; out.String() != want {
+		t.Errorf("RunTemplate() output = %q, want %q", out.String(), want)
+	}
+
+	if err := env.RunTemplate(context.Background(), "echo {{ .Missing", nil); err == nil {
+		t.Errorf("RunTemplate() expected error for an invalid template, got nil")
+	}
+}
+
+func TestRunWithRetry(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "marker")
+	script := `if [ -f "$MARKER" ]; then exit 0; fi; touch "$MARKER"; exit 1`
+
+	attempts := 0
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   10 * time.Millisecond,
+		ShouldRetry: func(err error) bool {
+			attempts++
+			return true
+		},
+	}
+
+	env := NewEnvironment(Bash())
+	if err := env.RunWithRetry(context.Background(), script, policy, "MARKER", marker); err != nil {
+		t.Fatalf("RunWithRetry() error = %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("RunWithRetry() retried %d times, want 1", attempts)
+	}
+
+	policy.ShouldRetry = func(err error) bool {
+		var exitErr ExitError
+		return errors.As(err, &exitErr) && exitErr.ExitCode() != 2
+	}
+	if err := env.RunWithRetry(context.Background(), "exit 2", policy); err == nil {
+		t.Errorf("RunWithRetry() expected error, got nil")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	policy = RetryPolicy{MaxAttempts: 10, BaseDelay: time.Minute}
+	if err := env.RunWithRetry(ctx, "exit 1", policy); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RunWithRetry() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestWorkigDir(t *testing.T) {
+	shells := commonShells()
+
+	var stdout bytes.Buffer
+	env := Environment{
+		workingDir: "/tmp",
+		stdout:     &stdout,
+	}
+
+	for _, shell := range shells {
+		t.Run("WorkingDir_"+shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+			stdout.Reset()
+			env.shell = shell
+			if err := env.Run(context.Background(), "pwd"); err != nil {
+				t.Errorf("Run() error = %v", err)
+			}
+
+			if stdout.String() != "/tmp\n" {
+				t.Errorf("Run() stdout = %v, want %v", stdout.String(), "/tmp")
+			}
+		})
+	}
+}
+
+func TestRunInDir(t *testing.T) {
+	var stdout bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&stdout))
+
+	if err := env.RunInDir(context.Background(), "/tmp", "pwd"); err != nil {
+		t.Fatalf("RunInDir() error = %v", err)
+	}
+	if stdout.String() != "/tmp\n" {
+		t.Errorf("RunInDir() stdout = %q, want %q", stdout.String(), "/tmp\n")
+	}
+	if env.workingDir != "" {
+		t.Errorf("RunInDir() modified environment workingDir = %q", env.workingDir)
+	}
+
+	err := env.RunInDir(context.Background(), "/nonexistent/dir", "pwd")
+	if err == nil || !strings.Contains(err.Error(), "working directory") {
+		t.Errorf("RunInDir() error = %v, want invalid working directory error", err)
+	}
+}
+
+func TestRunFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script.sh")
+	script := "echo \"$TEST_ARG $1\"\nexit 3\n"
+	if err := os.WriteFile(path, []byte(script), 0o644); err != nil {
+		t.Fatalf("failed to write script: %v", err)
+	}
+
+	for _, shell := range posixShells() {
+		t.Run("RunFile_"+shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+
+			var stdout bytes.Buffer
+			env := NewEnvironment(shell, WithStdout(&stdout))
+
+			err := env.RunFile(context.Background(), path, "TEST_ARG", "hello", Positional("world"))
+			var exitErr ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+				t.Errorf("RunFile() error = %v, want exit code 3", err)
+			}
+
+			if stdout.String() != "hello world\n" {
+				t.Errorf("RunFile() stdout = %q, want %q", stdout.String(), "hello world\n")
+			}
+		})
+	}
+
+	out, err := NewEnvironment(Bash()).OutputFile(context.Background(), path, "TEST_ARG", "hello")
+	if err == nil {
+		t.Errorf("OutputFile() expected error, got nil")
+	}
+	if string(out) != "hello \n" {
+		t.Errorf("OutputFile() = %q, want %q", out, "hello \n")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var stdout bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&stdout))
+
+	got, err := env.DryRun(context.Background(), "echo $WHO > /tmp/dry-run", "WHO", "it's me")
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+
+	want := `WHO='it'\''s me' bash -c 'echo $WHO > /tmp/dry-run'`
+	if got != want {
+		t.Errorf("DryRun() = %v, want %v", got, want)
+	}
+
+	if stdout.Len() != 0 {
+		t.Errorf("DryRun() executed the script, stdout = %q", stdout.String())
+	}
+
+	got, err = NewEnvironment(Bash(), WithCleanEnv()).DryRun(context.Background(), "true", Positional("a b"))
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+
+	want = `env -i bash -c true bash 'a b'`
+	if got != want {
+		t.Errorf("DryRun() = %v, want %v", got, want)
+	}
+}
+
+type envShell struct {
+	Shell
+	env map[string]string
+}
+
+func (s *envShell) Env() map[string]string {
+	return s.env
+}
+
+func TestEnvProvider(t *testing.T) {
+	shell := &envShell{
+		Shell: Bash(),
+		env: map[string]string{
+			"FOO": "bar",
+			"BAZ": "shell",
+		},
+	}
+
+	out, err := NewEnvironment(shell).Output(context.Background(), "echo $FOO $BAZ", "BAZ", "arg")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if string(out) != "bar arg\n" {
+		t.Errorf("Output() = %q, want %q", out, "bar arg\n")
+	}
+}
+
+func TestShellArgs(t *testing.T) {
+	var stdout bytes.Buffer
+	env := NewEnvironment(Bash(), WithStdout(&stdout), WithShellArgs("-e"))
+
+	if err := env.Run(context.Background(), "false; echo after"); err == nil {
+		t.Errorf("Run() expected error, got nil")
+	}
+
+	if stdout.Len() != 0 {
+		t.Errorf("Run() stdout = %q, want empty", stdout.String())
+	}
+
+	cmd, err := env.command(context.Background(), source{script: "true"})
+	env.cleanup()
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+	want := []string{"bash", "-e", "-c", "true"}
+	if !slices.Equal(cmd.Args, want) {
+		t.Errorf("command() args = %v, want %v", cmd.Args, want)
+	}
+}
+
+func TestFeatureReporter(t *testing.T) {
+	tt := map[string]struct {
+		shell    Shell
+		pipefail bool
+		arrays   bool
+	}{
+		"bash": {shell: Bash(), pipefail: true, arrays: true},
+		"zsh":  {shell: Zsh(), pipefail: true, arrays: true},
+		"ksh":  {shell: Ksh(), pipefail: true, arrays: true},
+		"sh":   {shell: Sh(), pipefail: false, arrays: false},
+		"dash": {shell: Dash(), pipefail: false, arrays: false},
+		"ash":  {shell: Ash(), pipefail: true, arrays: false},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			fr, ok := tc.shell.(FeatureReporter)
+			if !ok {
+				t.Fatalf("%s does not implement FeatureReporter", name)
+			}
+
+			if got := fr.Supports(FeaturePipefail); got != tc.pipefail {
+				t.Errorf("Supports(%q) = %v, want %v", FeaturePipefail, got, tc.pipefail)
+			}
+			if got := fr.Supports(FeatureArrays); got != tc.arrays {
+				t.Errorf("Supports(%q) = %v, want %v", FeatureArrays, got, tc.arrays)
+			}
+			if fr.Supports("unknown") {
+				t.Errorf("Supports(%q) = true, want false", "unknown")
+			}
+		})
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	for _, shell := range posixShells() {
+		t.Run("StrictMode_"+shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+
+			var stdout bytes.Buffer
+			env := NewEnvironment(shell, WithStdout(&stdout), WithStrictMode())
+
+			if err := env.Run(context.Background(), "false; echo reached"); err == nil {
+				t.Errorf("Run() expected error, got nil")
+			}
+			if err := env.Run(context.Background(), "echo $UNSET_VARIABLE; echo reached"); err == nil {
+				t.Errorf("Run() expected error, got nil")
+			}
+			if stdout.Len() != 0 {
+				t.Errorf("Run() stdout = %q, want empty", stdout.String())
+			}
+
+			fr := shell.(FeatureReporter)
+			if fr.Supports(FeaturePipefail) {
+				if err := env.Run(context.Background(), "false | true"); err == nil {
+					t.Errorf("Run() expected pipefail error, got nil")
+				}
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, shell := range posixShells() {
+		t.Run("Check_"+shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+
+			var stdout bytes.Buffer
+			env := NewEnvironment(shell, WithStdout(&stdout))
+
+			if err := env.Check(context.Background(), "echo 'unterminated"); err == nil {
+				t.Errorf("Check() expected error, got nil")
+			}
+
+			if err := env.Check(context.Background(), "echo valid; exit 1"); err != nil {
+				t.Errorf("Check() error = %v", err)
+			}
+
+			if stdout.Len() != 0 {
+				t.Errorf("Check() executed the script, stdout = %q", stdout.String())
+			}
+		})
+	}
+
+	err := NewEnvironment(PowerShell()).Check(context.Background(), "echo valid")
+	if !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Check() error = %v, want %v", err, errors.ErrUnsupported)
+	}
+}
+
+func TestNoShell(t *testing.T) {
+	env := &Environment{}
+
+	if err := env.Run(context.Background(), "true"); !errors.Is(err, ErrNoShell) {
+		t.Errorf("Run() error = %v, want %v", err, ErrNoShell)
+	}
+
+	if _, err := env.Output(context.Background(), "true"); !errors.Is(err, ErrNoShell) {
+		t.Errorf("Output() error = %v, want %v", err, ErrNoShell)
+	}
+
+	if _, err := env.ResolveShell(); !errors.Is(err, ErrNoShell) {
+		t.Errorf("ResolveShell() error = %v, want %v", err, ErrNoShell)
+	}
+
+	if _, err := NewEnvironment(nil).DryRun(context.Background(), "true"); !errors.Is(err, ErrNoShell) {
+		t.Errorf("DryRun() error = %v, want %v", err, ErrNoShell)
+	}
+}
+
+func TestExportedShells(t *testing.T) {
+	for _, shell := range []Shell{Bash(), Sh(), Zsh(), Fish(), Dash(), Ksh(), Ash(), PowerShell(), Cmd()} {
+		if shell == nil {
+			t.Errorf("Shell %q is nil", shell.Name())
+		}
+	}
+}
+
+func TestBashAt(t *testing.T) {
+	path, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not installed")
+	}
+
+	shell := BashAt(path)
+	if shell.Name() != path {
+		t.Errorf("BashAt().Name() = %v, want %v", shell.Name(), path)
+	}
+
+	out, err := NewEnvironment(shell).Output(context.Background(), "echo $BASH_VERSION")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if len(strings.TrimSpace(string(out))) == 0 {
+		t.Errorf("Output() = %q, want bash version", out)
+	}
+
+	if Bash().Name() != "bash" {
+		t.Errorf("Bash().Name() = %v, want bash", Bash().Name())
+	}
+}
+
+func TestResolveShell(t *testing.T) {
+	requireShell(t, Bash())
+
+	path, err := NewEnvironment(Bash()).ResolveShell()
+	if err != nil {
+		t.Fatalf("ResolveShell() error = %v", err)
+	}
+	if !strings.HasSuffix(path, "bash") {
+		t.Errorf("ResolveShell() = %v, want path ending in bash", path)
+	}
+
+	_, err = NewEnvironment(BashAt("/nonexistent/bash")).ResolveShell()
+	if err == nil {
+		t.Fatalf("ResolveShell() expected error, got nil")
+	}
+}
+
+func TestPowerShell(t *testing.T) {
+	shell := PowerShell()
+	requireShell(t, shell)
+
+	out, err := NewEnvironment(shell).Output(context.Background(), "Write-Output $env:TEST_ARG", "TEST_ARG", "test_arg_value")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if got := strings.TrimSpace(string(out)); got != "test_arg_value" {
+		t.Errorf("Output() = %q, want %q", got, "test_arg_value")
+	}
+}
+
+func TestDefaultEnvironment(t *testing.T) {
+	if DefaultEnvironment().shell.Name() != "bash" {
+		t.Errorf("DefaultEnvironment().shell = %v, want bash", DefaultEnvironment().shell.Name())
+	}
+
+	var stdout bytes.Buffer
+	original := DefaultEnvironment()
+	defer SetDefaultEnvironment(original)
+
+	env := original.Clone()
+	env.Apply(WithStdout(&stdout))
+	SetDefaultEnvironment(env)
+
+	if DefaultEnvironment() != env {
+		t.Errorf("DefaultEnvironment() did not return the environment set by SetDefaultEnvironment")
+	}
+
+	if err := Run(context.Background(), "echo default"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if stdout.String() != "default\n" {
+		t.Errorf("Run() stdout = %q, want %q", stdout.String(), "default\n")
+	}
+}
+
+func TestSetDefaultEnvironment(t *testing.T) {
+	defer SetDefaultEnvironment(DefaultEnvironment())
+
+	if defaultEnvironment.shell.Name() != Bash().Name() {
+		t.Errorf("defaultEnvironment.shell = %v, want %v", defaultEnvironment.shell.Name(), Bash().Name())
+	}
+
+	SetDefaultEnvironment(NewEnvironment(Sh()))
+	if defaultEnvironment.shell.Name() != Sh().Name() {
+		t.Errorf("defaultEnvironment.shell = %v, want %v", defaultEnvironment.shell.Name(), Sh().Name())
+	}
+}
+
+func TestStdin(t *testing.T) {
+	shells := commonShells()
+
+	for _, shell := range shells {
+		t.Run("Stdin_"+shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+			var stdout bytes.Buffer
+			env := NewEnvironment(
+				shell,
+				WithStdin(strings.NewReader("line\n")),
+				WithStdout(&stdout),
+			)
+
+			if err := env.Run(context.Background(), "cat"); err != nil {
+				t.Errorf("Run() error = %v", err)
+			}
+
+			if stdout.String() != "line\n" {
+				t.Errorf("Run() stdout = %v, want %v", stdout.String(), "line\n")
+			}
+		})
+	}
+}
+
+func TestCombinedOutput(t *testing.T) {
+	shells := commonShells()
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	env := Environment{
+		stdout: &stdout,
+		stderr: &stderr,
+	}
+
+	for _, shell := range shells {
+		t.Run("CombinedOutput_"+shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+			env.shell = shell
+
+			defer stdout.Reset()
+			defer stderr.Reset()
+
+			result, err := env.CombinedOutput(context.Background(), "echo out && echo err >&2")
+			if err != nil {
+				t.Fatalf("CombinedOutput() error = %v", err)
+			}
+
+			if string(result) != "out\nerr\n" {
+				t.Errorf("CombinedOutput() = %q, want %q", string(result), "out\nerr\n")
+			}
+
+			if stdout.Len() != 0 || stderr.Len() != 0 {
+				t.Errorf("CombinedOutput() wrote to configured writers: stdout = %q, stderr = %q", stdout.String(), stderr.String())
+			}
+		})
 	}
 }
@@ -0,0 +1,134 @@
+//go:build unix
+
+package sh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WithUmask sets the file mode creation mask of the script to mask.
+//
+// The mask is set by prepending "umask NNNN; " to inline scripts,
+// so it is not applied to scripts run using RunFile.
+func WithUmask(mask int) Option {
+	return func(e *Environment) {
+		e.umask = fmt.Sprintf("%04o", mask&0o777)
+	}
+}
+
+// WithCredential runs the script as the user uid and the group gid.
+//
+// The current process needs the privilege to change its credentials,
+// usually by running as root.
+func WithCredential(uid, gid uint32) Option {
+	return func(e *Environment) {
+		e.credential = &credential{uid: uid, gid: gid}
+	}
+}
+
+type credential struct {
+	uid uint32
+	gid uint32
+}
+
+func setCredential(cmd *exec.Cmd, c *credential) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: c.uid, Gid: c.gid}
+}
+
+func setProcessGroup(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	cmd.Cancel = func() error {
+		return signalProcessGroup(cmd.Process.Pid, os.Kill)
+	}
+
+	return nil
+}
+
+// setSignalGroup starts cmd in its own process group, so signals can be
+// sent to the processes it starts, without changing how it is cancelled.
+func setSignalGroup(cmd *exec.Cmd) bool {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	return true
+}
+
+// setCancelGrace makes cancelling cmd send SIGTERM and kill it after grace.
+// The returned function stops the pending kill of the process group,
+// and must be called once cmd is waited for, since the group id
+// may then be reused by unrelated processes.
+func setCancelGrace(cmd *exec.Cmd, grace time.Duration, processGroup bool) func() {
+	cmd.WaitDelay = grace
+
+	var mu sync.Mutex
+	var timer *time.Timer
+	stopped := false
+
+	cmd.Cancel = func() error {
+		if !processGroup {
+			return cmd.Process.Signal(syscall.SIGTERM)
+		}
+
+		// WaitDelay only kills the group leader, so the rest
+		// of the group is killed explicitly.
+		pid := cmd.Process.Pid
+		mu.Lock()
+		if !stopped {
+			timer = time.AfterFunc(grace, func() {
+				signalProcessGroup(pid, os.Kill)
+			})
+		}
+		mu.Unlock()
+		return signalProcessGroup(pid, syscall.SIGTERM)
+	}
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// signalProcessGroup sends sig to the process group led by pid.
+func signalProcessGroup(pid int, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal %v", sig)
+	}
+	return syscall.Kill(-pid, s)
+}
+
+// isBrokenPipe reports whether err is the exit of a script killed
+// by SIGPIPE, or of a shell whose command was, exiting with 128+SIGPIPE.
+func isBrokenPipe(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+	if ws.Signaled() {
+		return ws.Signal() == syscall.SIGPIPE
+	}
+	return ws.ExitStatus() == 128+int(syscall.SIGPIPE)
+}
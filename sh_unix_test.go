@@ -0,0 +1,343 @@
+//go:build unix
+
+package sh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUmask(t *testing.T) {
+	for _, shell := range posixShells() {
+		t.Run(shell.Name(), func(t *testing.T) {
+			requireShell(t, shell)
+
+			out, err := NewEnvironment(shell, WithUmask(0o027)).Output(context.Background(), "umask")
+			if err != nil {
+				t.Fatalf("Output() error = %v", err)
+			}
+
+			if got := strings.TrimSpace(string(out)); got != "0027" {
+				t.Errorf("umask = %q, want %q", got, "0027")
+			}
+		})
+	}
+}
+
+func TestCredential(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing credentials requires root")
+	}
+
+	const nobody = 65534
+	out, err := NewEnvironment(Sh(), WithCredential(nobody, nobody), WithWorkingDir("/")).Output(context.Background(), "id -u")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if got := strings.TrimSpace(string(out)); got != strconv.Itoa(nobody) {
+		t.Errorf("id -u = %q, want %d", got, nobody)
+	}
+}
+
+func TestSysProcAttr(t *testing.T) {
+	attr := &syscall.SysProcAttr{Setsid: true}
+
+	out, err := NewEnvironment(Sh(), WithSysProcAttr(attr)).OutputString(context.Background(), "echo $$ $(ps -o sid= -p $$)")
+	if err != nil {
+		t.Fatalf("OutputString() error = %v", err)
+	}
+
+	// The script is the leader of its own session.
+	if fields := strings.Fields(out); len(fields) != 2 || fields[0] != fields[1] {
+		t.Errorf("pid and session id = %q, want the script to lead its session", out)
+	}
+
+	attr = &syscall.SysProcAttr{}
+	if err := NewEnvironment(Sh(), WithSysProcAttr(attr), WithProcessGroup()).Run(context.Background(), "true"); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if attr.Setpgid {
+		t.Errorf("WithProcessGroup() modified the attributes passed to WithSysProcAttr")
+	}
+}
+
+func TestForwardSignals(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	env := NewEnvironment(Bash(), WithStdout(pw), WithForwardSignals(os.Interrupt))
+	p, err := env.Start(
+		context.Background(),
+		"trap 'echo trapped; exit 0' INT; echo ready; while true; do sleep 0.1; done",
+	)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	lines := bufio.NewScanner(pr)
+	if !lines.Scan() || lines.Text() != "ready" {
+		t.Fatalf("script did not report ready: %q", lines.Text())
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatalf("failed to send SIGINT: %v", err)
+	}
+
+	if !lines.Scan() || lines.Text() != "trapped" {
+		t.Errorf("script output = %q, want trapped", lines.Text())
+	}
+
+	if err := p.Wait(); err != nil {
+		t.Errorf("Wait() error = %v", err)
+	}
+}
+
+func TestForwardSignalsGroup(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	env := NewEnvironment(Bash(), WithStdout(pw), WithForwardSignals(syscall.SIGUSR1))
+	p, err := env.Start(
+		context.Background(),
+		`sh -c 'trap "echo trapped; exit 0" USR1; echo ready; i=0; while [ $i -lt 50 ]; do sleep 0.1; i=$((i+1)); done; echo timeout'; exit 0`,
+	)
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	lines := bufio.NewScanner(pr)
+	if !lines.Scan() || lines.Text() != "ready" {
+		t.Fatalf("script did not report ready: %q", lines.Text())
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("failed to send SIGUSR1: %v", err)
+	}
+
+	if !lines.Scan() || lines.Text() != "trapped" {
+		t.Errorf("child of the script output = %q, want trapped", lines.Text())
+	}
+
+	// The script itself does not trap the signal.
+	p.Wait()
+}
+
+func TestProcessGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	env := NewEnvironment(Bash(), WithStdout(pw), WithProcessGroup())
+	p, err := env.Start(ctx, "sleep 100 & echo $!; wait")
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	lines := bufio.NewScanner(pr)
+	if !lines.Scan() {
+		t.Fatalf("script did not report the background pid")
+	}
+	pid, err := strconv.Atoi(lines.Text())
+	if err != nil {
+		t.Fatalf("invalid background pid %q: %v", lines.Text(), err)
+	}
+
+	cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Wait() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait() did not return after cancel")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("background process %d is still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// processAlive reports whether pid is running and is not a zombie.
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return syscall.Kill(pid, 0) == nil
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	err := NewEnvironment(Bash()).Run(ctx, "sleep 5")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Run() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestCancelGrace(t *testing.T) {
+	t.Run("Terminate", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		pr, pw := io.Pipe()
+		defer pr.Close()
+
+		env := NewEnvironment(Bash(), WithStdout(pw), WithCancelGrace(5*time.Second))
+		p, err := env.Start(ctx, "trap 'echo cleanup; exit 1' TERM; echo ready; while true; do sleep 0.1; done")
+		if err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+
+		lines := bufio.NewScanner(pr)
+		if !lines.Scan() || lines.Text() != "ready" {
+			t.Fatalf("script did not report ready: %q", lines.Text())
+		}
+
+		cancel()
+
+		if !lines.Scan() || lines.Text() != "cleanup" {
+			t.Errorf("script output = %q, want cleanup", lines.Text())
+		}
+
+		if err := p.Wait(); !errors.Is(err, context.Canceled) {
+			t.Errorf("Wait() error = %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("Kill", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		env := NewEnvironment(Bash(), WithCancelGrace(200*time.Millisecond))
+
+		start := time.Now()
+		err := env.Run(ctx, "trap '' TERM; while true; do sleep 0.1; done")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Run() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("Run() took %v, want the script to be killed after the grace period", elapsed)
+		}
+	})
+}
+
+func TestWhichTimeout(t *testing.T) {
+	// BASH_ENV is sourced before the script, delaying the lookup.
+	bashEnv := filepath.Join(t.TempDir(), "env.sh")
+	if err := os.WriteFile(bashEnv, []byte("sleep 5\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	env := NewEnvironment(
+		Bash(),
+		WithTimeout(100*time.Millisecond),
+		WithProcessGroup(),
+		WithEnv(map[string]string{"BASH_ENV": bashEnv}),
+	)
+	_, err := env.Which(context.Background(), "echo")
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("Which() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPipeBrokenPipe(t *testing.T) {
+	env := NewEnvironment(Bash())
+
+	// yes is killed by SIGPIPE when head exits, which is not a failure.
+	out, err := env.Pipe(context.Background(), "yes", "head -n 1")
+	if err != nil {
+		t.Errorf("Pipe() error = %v, want nil", err)
+	}
+	if string(out) != "y\n" {
+		t.Errorf("Pipe() = %q, want %q", out, "y\n")
+	}
+
+	for _, scripts := range [][]string{
+		{"echo hello", "exit 4", "cat"},
+		{"yes", "exit 4", "cat"},
+		{"yes; echo done", "exit 4", "cat"},
+	} {
+		_, err = env.Pipe(context.Background(), scripts...)
+		var exitErr ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 4 {
+			t.Errorf("Pipe(%q) error = %v, want exit code 4", scripts, err)
+		}
+		if err == nil || !strings.Contains(err.Error(), "stage 1") || strings.Contains(err.Error(), "stage 0") {
+			t.Errorf("Pipe(%q) error = %v, want to mention only stage 1", scripts, err)
+		}
+	}
+}
+
+func TestCancelGraceStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", "trap '' TERM; echo ready; sleep 2")
+	if err := setProcessGroup(cmd); err != nil {
+		t.Fatal(err)
+	}
+	stop := setCancelGrace(cmd, 50*time.Millisecond, true)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the trap to be set.
+	if _, err := bufio.NewReader(stdout).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	defer func() {
+		signalProcessGroup(cmd.Process.Pid, os.Kill)
+		<-done
+	}()
+
+	// The group ignores SIGTERM, and the pending kill is stopped,
+	// as it would be once the script is waited for.
+	if err := cmd.Cancel(); err != nil {
+		t.Fatalf("Cancel() error = %v", err)
+	}
+	stop()
+
+	select {
+	case err := <-done:
+		done <- err
+		t.Errorf("process group was killed after the kill was stopped: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,41 @@
+//go:build windows
+
+package sh
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestCmd(t *testing.T) {
+	shell := Cmd()
+	requireShell(t, shell)
+
+	out, err := NewEnvironment(shell).Output(context.Background(), "echo %FOO%", "FOO", "bar")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if got := strings.TrimSpace(string(out)); got != "bar" {
+		t.Errorf("Output() = %q, want %q", got, "bar")
+	}
+}
+
+func TestWSL(t *testing.T) {
+	shell := WSL("", Sh())
+	requireShell(t, shell)
+	if err := exec.Command("wsl", "--list", "--quiet").Run(); err != nil {
+		t.Skip("no WSL distribution is installed")
+	}
+
+	out, err := NewEnvironment(shell).OutputString(context.Background(), "uname")
+	if err != nil {
+		t.Fatalf("OutputString() error = %v", err)
+	}
+
+	if out != "Linux" {
+		t.Errorf("OutputString() = %q, want %q", out, "Linux")
+	}
+}
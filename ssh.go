@@ -0,0 +1,137 @@
+package sh
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SSHOption configures the Shell returned by SSH.
+type SSHOption func(*sshShell)
+
+// WithSSHUser sets the user to log in as on the remote host.
+func WithSSHUser(user string) SSHOption {
+	return func(s *sshShell) {
+		s.user = user
+	}
+}
+
+// WithSSHPort sets the port to connect to on the remote host.
+func WithSSHPort(port int) SSHOption {
+	return func(s *sshShell) {
+		s.port = port
+	}
+}
+
+// WithSSHIdentity sets the private key file used for authentication.
+func WithSSHIdentity(path string) SSHOption {
+	return func(s *sshShell) {
+		s.identity = path
+	}
+}
+
+// WithSSHConfig passes an option in the ssh_config format,
+// like "StrictHostKeyChecking=no", using -o.
+func WithSSHConfig(option string) SSHOption {
+	return func(s *sshShell) {
+		s.options = append(s.options, option)
+	}
+}
+
+// WithSSHRemoteShell sets the shell used to run the script
+// on the remote host. The default is Bash.
+func WithSSHRemoteShell(shell Shell) SSHOption {
+	return func(s *sshShell) {
+		s.shell = shell
+	}
+}
+
+// SSH returns a Shell that runs scripts on a remote host using ssh.
+//
+// Environment variables are not forwarded by ssh, so the variables set
+// using WithEnv and extra args are sent on the ssh command line
+// as VAR=value prefixes of the remote shell invocation. The remote command
+// is quoted for a POSIX login shell on the remote host.
+func SSH(host string, opts ...SSHOption) Shell {
+	s := &sshShell{
+		host:  host,
+		shell: Bash(),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+type sshShell struct {
+	host     string
+	user     string
+	port     int
+	identity string
+	options  []string
+	shell    Shell
+}
+
+func (s *sshShell) Name() string {
+	return "ssh"
+}
+
+func (s *sshShell) Prefix() []string {
+	args := s.sshArgs()
+	args = append(args, s.shell.Name())
+	return append(args, s.shell.Prefix()...)
+}
+
+func (s *sshShell) Suffix() []string {
+	return s.shell.Suffix()
+}
+
+func (s *sshShell) FormatArgs(inv Invocation) []string {
+	args := s.sshArgs()
+	return append(args, remoteCommand(s.shell, inv))
+}
+
+func (s *sshShell) wrapped() Shell {
+	return s.shell
+}
+
+func (s *sshShell) Supports(feature string) bool {
+	fr, ok := s.shell.(FeatureReporter)
+	return ok && fr.Supports(feature)
+}
+
+func (s *sshShell) sshArgs() []string {
+	var args []string
+	if s.port > 0 {
+		args = append(args, "-p", strconv.Itoa(s.port))
+	}
+	if s.identity != "" {
+		args = append(args, "-i", s.identity)
+	}
+	for _, opt := range s.options {
+		args = append(args, "-o", opt)
+	}
+
+	dest := s.host
+	if s.user != "" {
+		dest = s.user + "@" + s.host
+	}
+
+	return append(args, dest, "--")
+}
+
+// remoteCommand returns the invocation of shell as a single command line,
+// quoted for a POSIX shell, with the environment set using VAR=value prefixes.
+func remoteCommand(shell Shell, inv Invocation) string {
+	var words []string
+	for _, arg := range inv.Env {
+		words = append(words, arg.Key+"="+quote(arg.Value))
+	}
+
+	for _, arg := range innerArgs(shell, inv) {
+		words = append(words, quote(arg))
+	}
+
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,99 @@
+package sh
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestSSHArgs(t *testing.T) {
+	shell := SSH(
+		"example.com",
+		WithSSHUser("deploy"),
+		WithSSHPort(2222),
+		WithSSHIdentity("/keys/id_ed25519"),
+		WithSSHConfig("BatchMode=yes"),
+	)
+
+	if shell.Name() != "ssh" {
+		t.Errorf("Name() = %v, want ssh", shell.Name())
+	}
+
+	env := NewEnvironment(shell, WithEnv(map[string]string{"FROM_ENV": "env"}))
+	defer env.cleanup()
+
+	cmd, err := env.command(context.Background(), source{script: "echo $FOO $1"}, "FOO", "it's", Positional("a b"))
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+
+	want := []string{
+		"ssh",
+		"-p", "2222",
+		"-i", "/keys/id_ed25519",
+		"-o", "BatchMode=yes",
+		"deploy@example.com",
+		"--",
+		`FROM_ENV=env FOO='it'\''s' bash -c 'echo $FOO $1' bash 'a b'`,
+	}
+	if !slices.Equal(cmd.Args, want) {
+		t.Errorf("command() args = %q, want %q", cmd.Args, want)
+	}
+}
+
+func TestSSH(t *testing.T) {
+	host := os.Getenv("SH_TEST_SSH_HOST")
+	if host == "" {
+		t.Skip("SH_TEST_SSH_HOST is not set")
+	}
+
+	out, err := NewEnvironment(SSH(host, WithSSHConfig("BatchMode=yes"))).Output(context.Background(), "echo $FOO", "FOO", "bar")
+	if err != nil {
+		t.Fatalf("Output() error = %v", err)
+	}
+
+	if string(out) != "bar\n" {
+		t.Errorf("Output() = %q, want %q", out, "bar\n")
+	}
+}
+
+func TestSSHRejectsInvalidNames(t *testing.T) {
+	const hostile = "X;touch /tmp/pwn;Y"
+
+	for _, shell := range []Shell{SSH("example.com"), NixShell("hello", Bash())} {
+		for name, env := range map[string]*Environment{
+			"WithEnv": NewEnvironment(shell, WithEnv(map[string]string{hostile: "1"})),
+			"WithEnvFunc": NewEnvironment(shell, WithEnvFunc(func(context.Context) (map[string]string, error) {
+				return map[string]string{hostile: "1"}, nil
+			})),
+		} {
+			if _, err := env.DryRun(context.Background(), "true"); err == nil {
+				t.Errorf("%s: DryRun() with %s expected error, got nil", shell.Name(), name)
+			}
+		}
+
+		env := NewEnvironment(shell)
+		if _, err := env.DryRun(context.Background(), "true", map[string]string{hostile: "1"}); err == nil {
+			t.Errorf("%s: DryRun() with a map arg expected error, got nil", shell.Name())
+		}
+		if _, err := env.DryRun(context.Background(), "true", Arg{Key: hostile, Value: "1"}); err == nil {
+			t.Errorf("%s: DryRun() with an Arg expected error, got nil", shell.Name())
+		}
+	}
+}
+
+func TestSSHFishPositional(t *testing.T) {
+	env := NewEnvironment(SSH("example.com", WithSSHRemoteShell(Fish())))
+	defer env.cleanup()
+
+	cmd, err := env.command(context.Background(), source{script: "echo $argv"}, Positional("a b"))
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+
+	want := []string{"ssh", "example.com", "--", `fish -c 'echo $argv' 'a b'`}
+	if !slices.Equal(cmd.Args, want) {
+		t.Errorf("command() args = %q, want %q", cmd.Args, want)
+	}
+}
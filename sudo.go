@@ -0,0 +1,67 @@
+package sh
+
+// SudoOption configures the Shell returned by Sudo.
+type SudoOption func(*sudoShell)
+
+// WithPreserveEnv passes -E to sudo, so the variables set using WithEnv
+// and extra args are preserved, if the security policy allows it.
+func WithPreserveEnv() SudoOption {
+	return func(s *sudoShell) {
+		s.preserveEnv = true
+	}
+}
+
+// Sudo returns a Shell that runs scripts using shell as root, as in
+// "sudo bash -c script".
+//
+// By default, sudo resets the environment, so the variables set using
+// WithEnv and extra args are only visible to the script with WithPreserveEnv.
+func Sudo(shell Shell, opts ...SudoOption) Shell {
+	s := &sudoShell{
+		shell: shell,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+type sudoShell struct {
+	shell       Shell
+	preserveEnv bool
+}
+
+func (s *sudoShell) Name() string {
+	return "sudo"
+}
+
+func (s *sudoShell) Prefix() []string {
+	args := append(s.sudoArgs(), s.shell.Name())
+	return append(args, s.shell.Prefix()...)
+}
+
+func (s *sudoShell) Suffix() []string {
+	return s.shell.Suffix()
+}
+
+func (s *sudoShell) FormatArgs(inv Invocation) []string {
+	return append(s.sudoArgs(), innerArgs(s.shell, inv)...)
+}
+
+func (s *sudoShell) wrapped() Shell {
+	return s.shell
+}
+
+func (s *sudoShell) Supports(feature string) bool {
+	fr, ok := s.shell.(FeatureReporter)
+	return ok && fr.Supports(feature)
+}
+
+func (s *sudoShell) sudoArgs() []string {
+	if s.preserveEnv {
+		return []string{"-E"}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package sh
+
+import (
+	"context"
+	"os/exec"
+	"slices"
+	"testing"
+)
+
+func TestSudoArgs(t *testing.T) {
+	shell := Sudo(Bash(), WithPreserveEnv())
+	if shell.Name() != "sudo" {
+		t.Errorf("Name() = %v, want sudo", shell.Name())
+	}
+
+	wantPrefix := []string{"-E", "bash", "-c"}
+	if !slices.Equal(shell.Prefix(), wantPrefix) {
+		t.Errorf("Prefix() = %q, want %q", shell.Prefix(), wantPrefix)
+	}
+
+	env := NewEnvironment(shell)
+	defer env.cleanup()
+
+	cmd, err := env.command(context.Background(), source{script: "echo $1"}, Positional("a b"))
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+
+	want := []string{"sudo", "-E", "bash", "-c", "echo $1", "bash", "a b"}
+	if !slices.Equal(cmd.Args, want) {
+		t.Errorf("command() args = %q, want %q", cmd.Args, want)
+	}
+}
+
+func TestSudo(t *testing.T) {
+	if err := exec.Command("sudo", "-n", "true").Run(); err != nil {
+		t.Skip("passwordless sudo is not configured")
+	}
+
+	out, err := NewEnvironment(Sudo(Sh())).OutputString(context.Background(), "whoami")
+	if err != nil {
+		t.Fatalf("OutputString() error = %v", err)
+	}
+
+	if out != "root" {
+		t.Errorf("OutputString() = %q, want %q", out, "root")
+	}
+}
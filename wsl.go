@@ -0,0 +1,57 @@
+package sh
+
+// WSL returns a Shell that runs scripts using shell inside the
+// Windows Subsystem for Linux distribution distro, as in
+// "wsl -d distro --exec bash -c script". An empty distro
+// uses the default distribution.
+//
+// The command is run using --exec rather than --, so the script is not
+// interpreted by the default shell of the distribution first.
+// WSL only forwards the variables listed in WSLENV, so the variables set
+// using WithEnv and extra args must be listed there to reach the script,
+// for example by setting WSLENV to "FOO/u:BAR/u".
+func WSL(distro string, shell Shell) Shell {
+	return &wslShell{
+		distro: distro,
+		shell:  shell,
+	}
+}
+
+type wslShell struct {
+	distro string
+	shell  Shell
+}
+
+func (w *wslShell) Name() string {
+	return "wsl"
+}
+
+func (w *wslShell) Prefix() []string {
+	args := append(w.wslArgs(), w.shell.Name())
+	return append(args, w.shell.Prefix()...)
+}
+
+func (w *wslShell) Suffix() []string {
+	return w.shell.Suffix()
+}
+
+func (w *wslShell) FormatArgs(inv Invocation) []string {
+	return append(w.wslArgs(), innerArgs(w.shell, inv)...)
+}
+
+func (w *wslShell) wrapped() Shell {
+	return w.shell
+}
+
+func (w *wslShell) Supports(feature string) bool {
+	fr, ok := w.shell.(FeatureReporter)
+	return ok && fr.Supports(feature)
+}
+
+func (w *wslShell) wslArgs() []string {
+	var args []string
+	if w.distro != "" {
+		args = append(args, "-d", w.distro)
+	}
+	return append(args, "--exec")
+}
@@ -0,0 +1,32 @@
+package sh
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestWSLArgs(t *testing.T) {
+	shell := WSL("Ubuntu", Bash())
+	if shell.Name() != "wsl" {
+		t.Errorf("Name() = %v, want wsl", shell.Name())
+	}
+
+	wantPrefix := []string{"-d", "Ubuntu", "--exec", "bash", "-c"}
+	if !slices.Equal(shell.Prefix(), wantPrefix) {
+		t.Errorf("Prefix() = %q, want %q", shell.Prefix(), wantPrefix)
+	}
+
+	env := NewEnvironment(shell)
+	defer env.cleanup()
+
+	cmd, err := env.command(context.Background(), source{script: "echo $1"}, Positional("a"))
+	if err != nil {
+		t.Fatalf("command() error = %v", err)
+	}
+
+	want := []string{"wsl", "-d", "Ubuntu", "--exec", "bash", "-c", "echo $1", "bash", "a"}
+	if !slices.Equal(cmd.Args, want) {
+		t.Errorf("command() args = %q, want %q", cmd.Args, want)
+	}
+}